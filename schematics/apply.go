@@ -1,8 +1,13 @@
 package schematics
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	godiffpatch "github.com/sourcegraph/go-diff-patch"
@@ -13,6 +18,31 @@ const (
 	ConflictModeKeep      = "keep"
 	ConflictModeBackup    = "backup"
 	ConflictModeNew       = "new"
+	ConflictModeMerge     = "merge"
+)
+
+const (
+	OrphanRegionsModeSidecar = "sidecar"
+	OrphanRegionsModeAppend  = "append"
+	OrphanRegionsModeFail    = "fail"
+	OrphanRegionsModeDiscard = "discard"
+)
+
+var ErrOrphanRegions = errors.New("orphan regions")
+
+const (
+	ConflictRuleNewFile     = "new-file"
+	ConflictRuleDefault     = "default"
+	ConflictRuleManualEdits = "manual-edits"
+	ConflictRuleResolver    = "resolver"
+)
+
+const (
+	MergeModeRegions    = "regions"
+	MergeModeGoAST      = "go-ast"
+	MergeModeStructured = "structured"
+
+	MergeModeGeneratedBlocks = "generated-blocks"
 )
 
 type ApplyStore interface {
@@ -20,13 +50,37 @@ type ApplyStore interface {
 	ListFilenames(rexp *regexp.Regexp) (map[string]struct{}, error)
 	TargetFolder() string
 	FileExists(fn string) bool
-	RecoverRegionsOfFile(fromFile string, toContent []byte) ([]byte, error)
+	RecoverRegionsOfFile(fromFile string, toContent []byte, opts ...RegionOption) ([]byte, error)
 	ReadFile(fn string) ([]byte, error)
+	RemoveFile(fn string) error
+	RenameFile(fromFile string, toFile string) error
 }
 
+// ApplyTransaction stages the changes made by ExecutePlan: nothing is visible in the store until Commit. If Commit fails the store is
+// rolled back to the state it had when the transaction began.
+type ApplyTransaction interface {
+	WriteFile(fn string, p []byte) error
+	RemoveFile(fn string) error
+	RenameFile(fromFile string, toFile string) error
+	Commit() error
+	Rollback() error
+}
+
+// TransactionalApplyStore is implemented by the stores whose changes can be applied all together or not at all. ExecutePlan uses a
+// transaction when the store supports it.
+type TransactionalApplyStore interface {
+	BeginTransaction() (ApplyTransaction, error)
+}
+
+// ConflictPolicy selects the conflict mode of the existing files it matches: includeList is matched against the base name while
+// includeGlobs and excludeGlobs against the path relative to the target folder.
 type ConflictPolicy struct {
-	mode        string
-	includeList []*regexp.Regexp
+	name         string
+	mode         string
+	priority     int
+	includeList  []*regexp.Regexp
+	includeGlobs []string
+	excludeGlobs []string
 }
 
 type ApplyOptions struct {
@@ -35,10 +89,79 @@ type ApplyOptions struct {
 	onConflictPolicies      []ConflictPolicy
 	deleteOtherFiles        bool
 	deleteOtherFilesPattern *regexp.Regexp
+	staleFilesMode          string
+	quarantineFolder        string
+	shadowFolder            string
+	conflictResolver        ConflictResolver
+	conflictResolution      *ConflictResolution
+	manifest                bool
+	manifestSchematic       string
+	manifestVersion         string
+	previousManifest        *Manifest
 	flat                    bool
+	orphanRegionsMode       string
+	regionFingerprint       bool
+	mergeModes              map[string]string
+	structuredMergeConflict string
+	regionMigrations        []RegionMigration
+	textFormat              *TextFormat
+	manualEditsPolicy       string
+	regionReindent          *bool
 	writer                  ApplyStore
 }
 
+// OrphanRegion is a region of an existing file, with content, that is no longer declared by the template.
+type OrphanRegion struct {
+	Path    string `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Name    string `yaml:"name,omitempty" mapstructure:"name,omitempty" json:"name,omitempty"`
+	Size    int    `yaml:"size,omitempty" mapstructure:"size,omitempty" json:"size,omitempty"`
+	Mode    string `yaml:"mode,omitempty" mapstructure:"mode,omitempty" json:"mode,omitempty"`
+	Sidecar string `yaml:"sidecar,omitempty" mapstructure:"sidecar,omitempty" json:"sidecar,omitempty"`
+}
+
+// AppliedRegionMigration is a RegionMigration applied to the regions of an existing file.
+type AppliedRegionMigration struct {
+	Path string   `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	From []string `yaml:"from,omitempty" mapstructure:"from,omitempty" json:"from,omitempty"`
+	To   string   `yaml:"to,omitempty" mapstructure:"to,omitempty" json:"to,omitempty"`
+}
+
+// ManualEdit is an existing file whose content outside the regions has been edited by hand. Policy is the ManualEditsPolicy applied.
+type ManualEdit struct {
+	Path   string `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Policy string `yaml:"policy,omitempty" mapstructure:"policy,omitempty" json:"policy,omitempty"`
+}
+
+// ApplyFileResult reports what has been done with a target file. ConflictRule is what selected the ConflictMode: ConflictRuleNewFile,
+// ConflictRuleDefault, ConflictRuleManualEdits, ConflictRuleResolver or the name (or pattern) of the matching conflict rule.
+// LinesAdded and LinesRemoved compare the existing file with the generated content. RecoveredRegions are the regions whose content
+// comes from the existing file and Artifacts the companion files written (.bak, .patch, .new, .orphans). MovedTo is where a stale
+// file has been renamed or quarantined. Modified reports that the existing file has been changed since the generation recorded in
+// the manifest. Conflicts is the number of conflicts left by ConflictModeMerge.
+type ApplyFileResult struct {
+	Path             string   `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Action           string   `yaml:"action,omitempty" mapstructure:"action,omitempty" json:"action,omitempty"`
+	ConflictMode     string   `yaml:"conflict-mode,omitempty" mapstructure:"conflict-mode,omitempty" json:"conflict-mode,omitempty"`
+	ConflictRule     string   `yaml:"conflict-rule,omitempty" mapstructure:"conflict-rule,omitempty" json:"conflict-rule,omitempty"`
+	Size             int      `yaml:"size" mapstructure:"size" json:"size"`
+	PreviousSize     int      `yaml:"previous-size" mapstructure:"previous-size" json:"previous-size"`
+	LinesAdded       int      `yaml:"lines-added" mapstructure:"lines-added" json:"lines-added"`
+	LinesRemoved     int      `yaml:"lines-removed" mapstructure:"lines-removed" json:"lines-removed"`
+	RecoveredRegions []string `yaml:"recovered-regions,omitempty" mapstructure:"recovered-regions,omitempty" json:"recovered-regions,omitempty"`
+	Artifacts        []string `yaml:"artifacts,omitempty" mapstructure:"artifacts,omitempty" json:"artifacts,omitempty"`
+	MovedTo          string   `yaml:"moved-to,omitempty" mapstructure:"moved-to,omitempty" json:"moved-to,omitempty"`
+	Modified         bool     `yaml:"modified,omitempty" mapstructure:"modified,omitempty" json:"modified,omitempty"`
+	Conflicts        int      `yaml:"conflicts,omitempty" mapstructure:"conflicts,omitempty" json:"conflicts,omitempty"`
+}
+
+type ApplyResult struct {
+	Files            []ApplyFileResult        `yaml:"files,omitempty" mapstructure:"files,omitempty" json:"files,omitempty"`
+	OrphanRegions    []OrphanRegion           `yaml:"orphan-regions,omitempty" mapstructure:"orphan-regions,omitempty" json:"orphan-regions,omitempty"`
+	RegionMigrations []AppliedRegionMigration `yaml:"region-migrations,omitempty" mapstructure:"region-migrations,omitempty" json:"region-migrations,omitempty"`
+	ManualEdits      []ManualEdit             `yaml:"manual-edits,omitempty" mapstructure:"manual-edits,omitempty" json:"manual-edits,omitempty"`
+	Upgrade          *SchematicUpgrade        `yaml:"upgrade,omitempty" mapstructure:"upgrade,omitempty" json:"upgrade,omitempty"`
+}
+
 type ApplyOption func(*ApplyOptions)
 
 func WithApplyProduceDiff() ApplyOption {
@@ -66,10 +189,114 @@ func WithApplyConflictPolicy(m string, include []string) ApplyOption {
 			for _, s := range include {
 				cp.includeList = append(cp.includeList, regexp.MustCompile(s))
 			}
+			aopts.onConflictPolicies = append(aopts.onConflictPolicies, cp)
 		}
 	}
 }
 
+// WithApplyConflictRules appends glob based conflict rules to the policies. See ConflictPolicyRule.
+func WithApplyConflictRules(rules ...ConflictPolicyRule) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		for _, r := range rules {
+			aopts.onConflictPolicies = append(aopts.onConflictPolicies, ConflictPolicy{
+				name:         r.Name,
+				mode:         r.Mode,
+				priority:     r.Priority,
+				includeGlobs: r.Include,
+				excludeGlobs: r.Exclude,
+			})
+		}
+	}
+}
+
+// WithApplyConflictPolicyConfig applies a conflict policy file (see LoadConflictPolicyConfig): its default mode, if set, replaces
+// the default conflict mode and its rules are appended to the policies.
+func WithApplyConflictPolicyConfig(c ConflictPolicyConfig) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		if c.DefaultMode != "" {
+			aopts.defaultConflictMode = c.DefaultMode
+		}
+
+		WithApplyConflictRules(c.Rules...)(aopts)
+	}
+}
+
+// WithApplyOrphanRegionsMode sets what to do with the regions of the existing files that are not declared by the template anymore.
+// The default is OrphanRegionsModeSidecar: the regions are saved in a file.orphans file next to the target.
+func WithApplyOrphanRegionsMode(m string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.orphanRegionsMode = m
+	}
+}
+
+// WithApplyRegionFingerprint records in the region markers the fingerprint of their default content so that the regions
+// never edited get the new template defaults on the next generations.
+func WithApplyRegionFingerprint() ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.regionFingerprint = true
+	}
+}
+
+// WithApplyMergeMode sets how the existing files with the given extensions (i.e. '.go') are merged with the generated ones.
+// MergeModeRegions is the default. MergeModeGoAST, for Go files, recovers the regions and then keeps the top level
+// declarations found only in the existing file. MergeModeStructured, for JSON and YAML files, deep merges the documents.
+// MergeModeGeneratedBlocks keeps the existing files and refreshes their generated blocks only: it's implied for the files whose
+// template declares generated blocks.
+func WithApplyMergeMode(m string, exts ...string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		if aopts.mergeModes == nil {
+			aopts.mergeModes = make(map[string]string)
+		}
+
+		for _, ext := range exts {
+			aopts.mergeModes[strings.ToLower(ext)] = m
+		}
+	}
+}
+
+// WithApplyStructuredMergeConflict sets how the conflicting values are resolved by MergeModeStructured:
+// StructuredMergeConflictKeepCurrent (default) or StructuredMergeConflictUseGenerated.
+func WithApplyStructuredMergeConflict(rule string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.structuredMergeConflict = rule
+	}
+}
+
+// WithApplyRegionMigrations sets the region renames and merges, declared by the schematic, to be applied to the existing files
+// before their regions are recovered.
+func WithApplyRegionMigrations(migrations ...RegionMigration) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.regionMigrations = append(aopts.regionMigrations, migrations...)
+	}
+}
+
+// WithApplyTextFormat normalizes the line endings, the final newline and the BOM of the files whose regions are recovered.
+// By default the format of the existing files is preserved.
+func WithApplyTextFormat(tf TextFormat) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.textFormat = &tf
+	}
+}
+
+// WithApplyRegionReindent enables or disables the re-indentation of the recovered regions to the indentation of the new
+// markers. By default it's enabled for the indentation sensitive files only (i.e. YAML, Python).
+func WithApplyRegionReindent(enabled bool) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.regionReindent = &enabled
+	}
+}
+
+// WithApplyManualEditsPolicy embeds in the generated files a checksum of their content outside the regions. On the next Apply the
+// files overwritten (ConflictModeOverwrite or ConflictModeBackup) whose content outside the regions has been edited by hand are
+// handled according to the policy: ManualEditsPolicyWarn logs and overwrites, ManualEditsPolicyFail stops the Apply with
+// ErrManualEdits and ManualEditsPolicyNew falls back to ConflictModeNew for the file. The checksum is embedded only in the files
+// whose type supports comments.
+func WithApplyManualEditsPolicy(policy string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.manualEditsPolicy = policy
+	}
+}
+
 func WithDeleteOtherFiles(pattern string) ApplyOption {
 	return func(aopts *ApplyOptions) {
 		if pattern != "" {
@@ -79,6 +306,52 @@ func WithDeleteOtherFiles(pattern string) ApplyOption {
 	}
 }
 
+// WithApplyStaleFilesMode sets what to do with the files, found by WithDeleteOtherFiles, that are not produced by the current
+// generation: StaleFilesModeReport (default) only reports them, StaleFilesModeDelete deletes them, StaleFilesModeRename renames them
+// with the .del suffix and StaleFilesModeQuarantine moves them in the quarantine folder. As a safety rail only the files carrying
+// tpm-schematics markers (see IsGeneratedFile) are touched; the companion files (.bak, .patch, .new, .orphans) are never stale.
+func WithApplyStaleFilesMode(m string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.staleFilesMode = m
+	}
+}
+
+// WithApplyQuarantineFolder sets the folder, relative to the target folder if not absolute, where StaleFilesModeQuarantine moves
+// the stale files. The default is StaleFilesQuarantineFolder.
+func WithApplyQuarantineFolder(folder string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.quarantineFolder = folder
+	}
+}
+
+// WithApplyManifest writes in the target folder the ManifestFileName manifest recording the schematic, its version, the options and,
+// for each generated file, the hash of its content and its regions. The manifest of the previous generation, if found, is used to
+// tell the generated files from the hand-written ones (stale files, manual edits), to spot the modified files and the upgrades.
+func WithApplyManifest(schematic string, version string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.manifest = true
+		aopts.manifestSchematic = schematic
+		aopts.manifestVersion = version
+	}
+}
+
+// WithApplyShadowFolder sets the folder, relative to the target folder if not absolute, where a copy of the generated content of each
+// file is saved to be used as merge base by ConflictModeMerge. The copies are saved, in the ShadowFolder by default, whenever
+// ConflictModeMerge is in use.
+func WithApplyShadowFolder(folder string) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.shadowFolder = folder
+	}
+}
+
+// WithApplyConflictResolver sets the resolver asked the conflict mode of the existing files whose content would change. The mode
+// proposed to the resolver is the one selected by the conflict policies.
+func WithApplyConflictResolver(r ConflictResolver) ApplyOption {
+	return func(aopts *ApplyOptions) {
+		aopts.conflictResolver = r
+	}
+}
+
 func WithFilesystemStore(targetFolder string) ApplyOption {
 	return func(aopts *ApplyOptions) {
 		aopts.writer = &ApplyFileStore{targetFolder: targetFolder}
@@ -91,79 +364,275 @@ func WithStore(wrt ApplyStore) ApplyOption {
 	}
 }
 
-func Apply(files []OpNode, opts ...ApplyOption) error {
+func Apply(files []OpNode, opts ...ApplyOption) (ApplyResult, error) {
 
 	const semLogContext = "schematics::apply"
 
-	cfg := ApplyOptions{}
+	plan, err := Plan(files, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return plan.Result, err
+	}
+
+	return ExecutePlan(plan, opts...)
+}
+
+// Plan runs the region recovery, the merges and the conflict policies the way Apply does without writing to the store: the returned
+// plan lists, per file, the action to be taken and the files to be written. The plan can be executed later with ExecutePlan.
+func Plan(files []OpNode, opts ...ApplyOption) (ApplyPlan, error) {
+
+	const semLogContext = "schematics::plan"
+
+	cfg := ApplyOptions{orphanRegionsMode: OrphanRegionsModeSidecar}
 	for _, o := range opts {
 		o(&cfg)
 	}
 
-	var otherFiles map[string]struct{}
+	var plan ApplyPlan
+	var prevManifest Manifest
+	var ok bool
 	var err error
+	if cfg.isPreviousManifestNeeded() {
+		prevManifest, ok, err = ReadManifest(cfg.writer)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return plan, err
+		}
+
+		if ok {
+			cfg.previousManifest = &prevManifest
+		}
+	}
+
+	var manifest Manifest
+	if cfg.manifest {
+		manifest = Manifest{Schematic: cfg.manifestSchematic, Version: cfg.manifestVersion, Options: cfg.manifestOptions()}
+		if ok && prevManifest.Version != cfg.manifestVersion {
+			plan.Result.Upgrade = &SchematicUpgrade{Schematic: cfg.manifestSchematic, FromVersion: prevManifest.Version, ToVersion: cfg.manifestVersion}
+			log.Info().Str("schematic", cfg.manifestSchematic).Str("from-version", prevManifest.Version).Str("to-version", cfg.manifestVersion).Msg(semLogContext + " - upgrading")
+		}
+	}
+
+	var otherFiles map[string]struct{}
 	if cfg.deleteOtherFiles {
 		otherFiles, err = cfg.writer.ListFilenames(cfg.deleteOtherFilesPattern)
 		if err != nil {
 			log.Error().Err(err).Msg(semLogContext)
-			return err
+			return plan, err
 		}
 
 		log.Info().Int("num-files", len(otherFiles)).Msg(semLogContext + " files under target folder")
 	}
 
 	targetFolder := cfg.writer.TargetFolder()
-	var mergedFiles []OpNode
 	for _, f := range files {
+		targetPath := filepath.Join(targetFolder, f.Path)
+		if cfg.flat {
+			targetPath = filepath.Join(targetFolder, filepath.Base(f.Path))
+		}
+
 		if len(otherFiles) > 0 {
-			fullPath := filepath.Join(targetFolder, f.Path)
-			if _, ok := otherFiles[fullPath]; ok {
-				log.Trace().Str("file-name", fullPath).Msg(semLogContext + " clear from map")
-				delete(otherFiles, fullPath)
+			if _, ok := otherFiles[targetPath]; ok {
+				log.Trace().Str("file-name", targetPath).Msg(semLogContext + " clear from map")
+				delete(otherFiles, targetPath)
 			}
 		}
 
-		targetPath := filepath.Join(targetFolder, f.Path)
-		if cfg.flat {
-			targetPath = filepath.Join(targetFolder, filepath.Base(f.Path))
+		generated := f.Content
+		cm, rule, err := computeConflictMode(&cfg, targetPath)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return plan, err
 		}
 
-		if cfg.writer.FileExists(targetPath) {
-			log.Info().Str("path", targetPath).Msg(semLogContext + " - recovering regions")
-			b, err := cfg.writer.RecoverRegionsOfFile(targetPath, f.Content)
+		action := PlannedAction{Path: targetPath}
+		isUserOwned := cfg.mergeMode(targetPath) == MergeModeGeneratedBlocks || HasGeneratedBlocks(f.Content)
+		isChecksumEnabled := cfg.manualEditsPolicy != "" && cfg.manualEditsPolicy != ManualEditsPolicyIgnore && !isUserOwned
+
+		var orphans []RegionInfo
+		exists := cfg.writer.FileExists(targetPath)
+		if exists {
+			if isChecksumEnabled && (cm == ConflictModeOverwrite || cm == ConflictModeBackup) {
+				var manualEdit ManualEdit
+				cm, manualEdit, err = checkManualEditsOfFile(&cfg, targetPath, cm)
+				if !manualEdit.IsZero() {
+					plan.Result.ManualEdits = append(plan.Result.ManualEdits, manualEdit)
+					rule = ConflictRuleManualEdits
+				}
+
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+			}
+
+			if cm != ConflictModeKeep && len(cfg.regionMigrations) > 0 {
+				migrations, err := regionMigrationsOfFile(&cfg, targetPath)
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+				plan.Result.RegionMigrations = append(plan.Result.RegionMigrations, migrations...)
+			}
+
+			if isUserOwned {
+				// the file belongs to the user: only the generated blocks are refreshed.
+				log.Info().Str("path", targetPath).Msg(semLogContext + " - refreshing generated blocks")
+				f.Content, err = refreshGeneratedBlocksOfFile(&cfg, targetPath, f.Content)
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+			} else {
+				log.Info().Str("path", targetPath).Msg(semLogContext + " - recovering regions")
+				b, err := cfg.writer.RecoverRegionsOfFile(targetPath, f.Content, cfg.regionOptions()...)
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+				f.Content = b
+
+				switch cfg.mergeMode(targetPath) {
+				case MergeModeGoAST, MergeModeStructured:
+					b, err = mergeSourceOfFile(&cfg, targetPath, f.Content)
+					if err != nil {
+						log.Error().Err(err).Msg(semLogContext)
+						return plan, err
+					}
+					f.Content = b
+				}
+
+			}
+
+			candidate := f.Content
+			if isChecksumEnabled {
+				candidate, _, err = StampChecksum(targetPath, candidate)
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+			}
+
+			var isResolved bool
+			cm, isResolved, err = resolveConflictOfFile(&cfg, targetPath, candidate, cm)
 			if err != nil {
 				log.Error().Err(err).Msg(semLogContext)
-				return err
+				return plan, err
+			}
+
+			if isResolved {
+				rule = ConflictRuleResolver
+			}
+
+			if !isUserOwned && (cm == ConflictModeOverwrite || cm == ConflictModeBackup || cm == ConflictModeMerge) {
+				// the current file gets replaced: the regions not declared anymore would be lost.
+				orphans, err = findOrphanRegionsOfFile(&cfg, targetPath, f.Content)
+				if err != nil {
+					log.Error().Err(err).Msg(semLogContext)
+					return plan, err
+				}
+			}
+		} else if cfg.regionFingerprint {
+			b, err := StampRegionFingerprints(f.Content, WithRegionFileName(targetPath))
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
 			}
 			f.Content = b
 		}
 
-		cm, err := computeConflictMode(&cfg, targetPath)
-		if err != nil {
-			log.Error().Err(err).Msg(semLogContext)
-			return err
+		if len(orphans) > 0 {
+			var orphansNode OpNode
+			var orphanRegions []OrphanRegion
+			f.Content, orphansNode, orphanRegions, err = handleOrphanRegions(&cfg, targetPath, f.Content, orphans)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			plan.Result.OrphanRegions = append(plan.Result.OrphanRegions, orphanRegions...)
+			if !orphansNode.IsZero() {
+				action.Writes = append(action.Writes, orphansNode)
+			}
 		}
 
+		if isChecksumEnabled {
+			f.Content, _, err = StampChecksum(targetPath, f.Content)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+		}
+
+		// the generated content is the merge base of the next generation.
+		shadowContent := f.Content
+		mergeConflicts := 0
+		if cm == ConflictModeMerge {
+			merged, conflicts, ok, err := threeWayMergeOfFile(&cfg, targetPath, f.Content)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			if ok {
+				f.Content, mergeConflicts = merged, conflicts
+				if isChecksumEnabled {
+					f.Content, _, err = StampChecksum(targetPath, f.Content)
+					if err != nil {
+						log.Error().Err(err).Msg(semLogContext)
+						return plan, err
+					}
+				}
+			} else {
+				log.Warn().Str("path", targetPath).Msg(semLogContext + " - merge base not available, using " + ConflictModeNew)
+				cm = ConflictModeNew
+			}
+		}
+
+		action.ConflictMode = cm
 		switch cm {
+		case ConflictModeMerge:
+			action.Action, err = overwriteActionOf(&cfg, targetPath, exists, f.Content)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			if action.Action != PlanActionUnchanged {
+				action.Action = PlanActionMerge
+				action.Writes = append(action.Writes, OpNode{Path: targetPath, Content: f.Content})
+			}
 		case ConflictModeOverwrite:
-			mergedFiles = append(mergedFiles, OpNode{Path: targetPath, Content: f.Content})
-		case ConflictModeKeep:
-			// The file is not created. The previous is kept.
+			action.Action, err = overwriteActionOf(&cfg, targetPath, exists, f.Content)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			if action.Action != PlanActionUnchanged {
+				action.Writes = append(action.Writes, OpNode{Path: targetPath, Content: f.Content})
+			}
+		case ConflictModeKeep, "":
+			// The file is not created. The previous is kept (as it happens when no conflict mode is set).
+			action.Action = PlanActionKeep
 		case ConflictModeBackup:
+			action.Action = PlanActionUnchanged
 			pf, err := createPatchFile(&cfg, targetPath, f.Content)
 			if err != nil {
 				log.Error().Err(err).Msg(semLogContext)
-				return err
+				return plan, err
 			}
 
 			// if files are not different... nothing happens.
 			if !pf.IsZero() {
+				action.Action = PlanActionBackupOverwrite
+
 				// Since they are different it does make sense to produce the new file.
-				mergedFiles = append(mergedFiles, OpNode{Path: targetPath, Content: f.Content})
+				action.Writes = append(action.Writes, OpNode{Path: targetPath, Content: f.Content})
 
 				// files are different. check if the patch file has to be produced.
 				if cfg.produceDiff {
-					mergedFiles = append(mergedFiles, pf)
+					action.Writes = append(action.Writes, pf)
 				} else {
 					log.Info().Msg(semLogContext + " actual patch creation not enabled")
 				}
@@ -171,22 +640,25 @@ func Apply(files []OpNode, opts ...ApplyOption) error {
 				bck, err := createBackupFile(&cfg, targetPath)
 				if err != nil {
 					log.Error().Err(err).Msg(semLogContext)
-					return err
+					return plan, err
 				}
-				mergedFiles = append(mergedFiles, bck)
+				action.Writes = append(action.Writes, bck)
 			}
 		case ConflictModeNew:
+			action.Action = PlanActionUnchanged
 			pf, err := createPatchFile(&cfg, targetPath, f.Content)
 			if err != nil {
 				log.Error().Err(err).Msg(semLogContext)
-				return err
+				return plan, err
 			}
 
 			// if files are not different... nothing happens.
 			if !pf.IsZero() {
+				action.Action = PlanActionWriteNew
+
 				// files are different. check if the patch file has to be produced.
 				if cfg.produceDiff {
-					mergedFiles = append(mergedFiles, pf)
+					action.Writes = append(action.Writes, pf)
 				} else {
 					log.Info().Msg(semLogContext + " actual patch creation not enabled")
 				}
@@ -194,36 +666,89 @@ func Apply(files []OpNode, opts ...ApplyOption) error {
 				newf, err := createNewFile(targetPath, f.Content)
 				if err != nil {
 					log.Error().Err(err).Msg(semLogContext)
-					return err
+					return plan, err
 				}
-				mergedFiles = append(mergedFiles, newf)
+				action.Writes = append(action.Writes, newf)
 			}
+		default:
+			err = fmt.Errorf("%w %q for %s", ErrUnknownConflictMode, cm, targetPath)
+			log.Error().Err(err).Msg(semLogContext)
+			return plan, err
 		}
-	}
 
-	for _, mf := range mergedFiles {
-		log.Info().Str("file-name", mf.Path).Msg(semLogContext)
-		err := cfg.writer.WriteFile(mf.Path, mf.Content)
+		if (cfg.isShadowEnabled() || cm == ConflictModeMerge) && action.Action != PlanActionKeep && action.Action != PlanActionWriteNew {
+			shadow, err := planShadowCopy(&cfg, targetPath, shadowContent)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			if !shadow.IsZero() {
+				action.Writes = append(action.Writes, shadow)
+			}
+		}
+
+		fileResult, err := newApplyFileResult(&cfg, action, rule, exists, generated, f.Content)
 		if err != nil {
 			log.Error().Err(err).Msg(semLogContext)
-			return err
+			return plan, err
+		}
+		fileResult.Conflicts = mergeConflicts
+
+		plan.Actions = append(plan.Actions, action)
+		plan.Result.Files = append(plan.Result.Files, fileResult)
+
+		if cfg.manifest {
+			if action.Action == PlanActionKeep || action.Action == PlanActionWriteNew {
+				// the target is not changed: it's still the one of the previous generation.
+				if mf, ok := cfg.previousManifest.File(relativeTargetPath(targetFolder, targetPath)); ok {
+					manifest.Files = append(manifest.Files, mf)
+				}
+			} else {
+				manifest.Files = append(manifest.Files, newManifestFile(targetFolder, targetPath, f.Content))
+			}
 		}
 	}
 
 	if len(otherFiles) > 0 {
 		log.Info().Int("num-other-files", len(otherFiles)).Msg(semLogContext + " files not in current generation")
-		for n, _ := range otherFiles {
-			log.Info().Str("file-name", n).Msg(semLogContext + " file not in current generation")
-			/*
-				err = os.Rename(n, n+".del")
-				if err != nil {
-					log.Error().Err(err).Str("file-name", n).Msg(semLogContext)
-				}
-			*/
+		var names []string
+		for n := range otherFiles {
+			names = append(names, n)
+		}
+
+		sort.Strings(names)
+		for _, n := range names {
+			action, ok, err := planStaleFile(&cfg, n)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return plan, err
+			}
+
+			if ok {
+				plan.Actions = append(plan.Actions, action)
+				plan.Result.Files = append(plan.Result.Files, ApplyFileResult{Path: n, Action: action.Action, MovedTo: action.MoveTo})
+			}
+
+			// a stale file left in place is still the product of a previous generation.
+			if mf, isInManifest := cfg.previousManifest.File(relativeTargetPath(targetFolder, n)); cfg.manifest && isInManifest && action.Action == PlanActionStale {
+				manifest.Files = append(manifest.Files, mf)
+			}
+		}
+	}
+
+	if cfg.manifest {
+		action, fileResult, err := planManifest(&cfg, &manifest)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return plan, err
 		}
+
+		plan.Actions = append(plan.Actions, action)
+		plan.Result.Files = append(plan.Result.Files, fileResult)
 	}
 
-	return nil
+	return plan, nil
 }
 
 /*
@@ -252,23 +777,25 @@ func findFilesInTargetFolder(targetFolder string, rexp *regexp.Regexp) (map[stri
 }
 */
 
-func computeConflictMode(cfg *ApplyOptions, targetPath string) (string, error) {
+// computeConflictMode returns the conflict mode of the target and the rule that selected it.
+func computeConflictMode(cfg *ApplyOptions, targetPath string) (string, string, error) {
 	const semLogContext = "schematics::compute-conflict-mode"
 
 	if cfg.writer.FileExists(targetPath) {
-		baseName := filepath.Base(targetPath)
-		for _, p := range cfg.onConflictPolicies {
-			for _, r := range p.includeList {
-				if r.Match([]byte(baseName)) {
-					return p.mode, nil
-				}
-			}
+		mode, rule, ok, err := cfg.matchConflictPolicy(relativeTargetPath(cfg.writer.TargetFolder(), targetPath))
+		if err != nil {
+			log.Error().Err(err).Str("path", targetPath).Msg(semLogContext)
+			return "", "", err
 		}
 
-		return cfg.defaultConflictMode, nil
+		if ok {
+			return mode, rule, nil
+		}
+
+		return cfg.defaultConflictMode, ConflictRuleDefault, nil
 	}
 
-	return ConflictModeOverwrite, nil
+	return ConflictModeOverwrite, ConflictRuleNewFile, nil
 }
 
 func createPatchFile(cfg *ApplyOptions, targetPath string, content []byte) (OpNode, error) {
@@ -317,3 +844,370 @@ func createNewFile(targetPath string, content []byte) (OpNode, error) {
 	log.Info().Str("new-file", newFile).Msg(semLogContext)
 	return OpNode{Path: newFile, Content: []byte(content)}, nil
 }
+
+// regionOptions returns the options to be used, together with the file name, in the recovery of the regions.
+func (cfg *ApplyOptions) regionOptions() []RegionOption {
+	var opts []RegionOption
+	if cfg.regionFingerprint {
+		opts = append(opts, WithRegionFingerprint())
+	}
+
+	if len(cfg.regionMigrations) > 0 {
+		opts = append(opts, WithRegionMigrations(cfg.regionMigrations...))
+	}
+
+	if cfg.textFormat != nil {
+		opts = append(opts, WithRegionTextFormat(*cfg.textFormat))
+	}
+
+	if cfg.regionReindent != nil {
+		opts = append(opts, WithRegionReindent(*cfg.regionReindent))
+	}
+
+	return opts
+}
+
+func (cfg *ApplyOptions) mergeMode(targetPath string) string {
+	if m, ok := cfg.mergeModes[strings.ToLower(filepath.Ext(targetPath))]; ok {
+		return m
+	}
+
+	return MergeModeRegions
+}
+
+func mergeSourceOfFile(cfg *ApplyOptions, targetPath string, content []byte) ([]byte, error) {
+	const semLogContext = "schematics::merge-source-of-file"
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	if cfg.mergeMode(targetPath) == MergeModeStructured {
+		return MergeStructuredSource(targetPath, current, content, cfg.structuredMergeConflict)
+	}
+
+	return MergeGoSource(current, content)
+}
+
+func refreshGeneratedBlocksOfFile(cfg *ApplyOptions, targetPath string, content []byte) ([]byte, error) {
+	const semLogContext = "schematics::refresh-generated-blocks-of-file"
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	var opts []RegionOption
+	if cfg.textFormat != nil {
+		opts = append(opts, WithRegionTextFormat(*cfg.textFormat))
+	}
+
+	b, missing, err := RefreshGeneratedBlocks(current, content, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	for _, n := range missing {
+		log.Warn().Str("path", targetPath).Str("block", n).Msg(semLogContext + " - generated block not found in file")
+	}
+
+	return b, nil
+}
+
+func (me ManualEdit) IsZero() bool {
+	return me.Path == ""
+}
+
+// checkManualEditsOfFile applies the manual edits policy to the existing file. It returns the conflict mode to be used for the file.
+func checkManualEditsOfFile(cfg *ApplyOptions, targetPath string, cm string) (string, ManualEdit, error) {
+	const semLogContext = "schematics::check-manual-edits-of-file"
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return cm, ManualEdit{}, err
+	}
+
+	edited, err := IsEditedOutsideRegions(targetPath, current)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return cm, ManualEdit{}, err
+	}
+
+	// the files that cannot embed the checksum rely on the one recorded in the manifest.
+	if _, ok := ReadEmbeddedChecksum(current); !ok {
+		if mf, ok := cfg.previousManifest.File(relativeTargetPath(cfg.writer.TargetFolder(), targetPath)); ok && mf.Checksum != "" {
+			checksum, err := ComputeChecksum(current, WithRegionFileName(targetPath))
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return cm, ManualEdit{}, err
+			}
+			edited = checksum != mf.Checksum
+		}
+	}
+
+	if !edited {
+		return cm, ManualEdit{}, nil
+	}
+
+	manualEdit := ManualEdit{Path: targetPath, Policy: cfg.manualEditsPolicy}
+	switch cfg.manualEditsPolicy {
+	case ManualEditsPolicyFail:
+		err = fmt.Errorf("%w: %s", ErrManualEdits, targetPath)
+		log.Error().Err(err).Msg(semLogContext)
+		return cm, manualEdit, err
+	case ManualEditsPolicyNew:
+		log.Warn().Str("path", targetPath).Msg(semLogContext + " - file edited outside regions, creating new file")
+		return ConflictModeNew, manualEdit, nil
+	default:
+		log.Warn().Str("path", targetPath).Msg(semLogContext + " - file edited outside regions, the edits are going to be overwritten")
+	}
+
+	return cm, manualEdit, nil
+}
+
+func regionMigrationsOfFile(cfg *ApplyOptions, targetPath string) ([]AppliedRegionMigration, error) {
+	const semLogContext = "schematics::region-migrations-of-file"
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	regs, err := ReadRegionsFromBuffer(current, WithRegionFileName(targetPath))
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	var out []AppliedRegionMigration
+	_, applied := MigrateRegions(regs, cfg.regionMigrations)
+	for _, m := range applied {
+		out = append(out, AppliedRegionMigration{Path: targetPath, From: m.From, To: m.To})
+	}
+
+	return out, nil
+}
+
+func findOrphanRegionsOfFile(cfg *ApplyOptions, targetPath string, content []byte) ([]RegionInfo, error) {
+	const semLogContext = "schematics::find-orphan-regions-of-file"
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	orphans, err := FindOrphanRegions(current, content, append([]RegionOption{WithRegionFileName(targetPath)}, cfg.regionOptions()...)...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	for _, o := range orphans {
+		log.Warn().Str("path", targetPath).Str("region", o.Name).Int("size", o.Size).Msg(semLogContext + " - region not declared by the template")
+	}
+
+	return orphans, nil
+}
+
+// handleOrphanRegions applies the orphan regions mode. It returns the content of the target (with the commented regions in
+// append mode) and the sidecar file to be written if any.
+func handleOrphanRegions(cfg *ApplyOptions, targetPath string, content []byte, orphans []RegionInfo) ([]byte, OpNode, []OrphanRegion, error) {
+	const semLogContext = "schematics::handle-orphan-regions"
+
+	mode := cfg.orphanRegionsMode
+	var commentSyntax *RegionSyntax
+	if mode == OrphanRegionsModeAppend {
+		for _, rs := range RegionSyntaxesForFile(targetPath) {
+			if rs.CommentStart != "" {
+				commentSyntax = &rs
+				break
+			}
+		}
+
+		if commentSyntax == nil {
+			log.Warn().Str("path", targetPath).Msg(semLogContext + " - cannot comment out regions in file, using sidecar")
+			mode = OrphanRegionsModeSidecar
+		}
+	}
+
+	var regionNames []string
+	var out []OrphanRegion
+	for _, o := range orphans {
+		regionNames = append(regionNames, o.Name)
+		out = append(out, OrphanRegion{Path: targetPath, Name: o.Name, Size: o.Size, Mode: mode})
+	}
+
+	var sidecar OpNode
+	switch mode {
+	case OrphanRegionsModeFail:
+		err := fmt.Errorf("%w in %s: %s", ErrOrphanRegions, targetPath, strings.Join(regionNames, ", "))
+		log.Error().Err(err).Msg(semLogContext)
+		return content, sidecar, out, err
+	case OrphanRegionsModeDiscard:
+		return content, sidecar, out, nil
+	case OrphanRegionsModeAppend:
+		var sb strings.Builder
+		sb.Write(content)
+		if len(content) > 0 && !strings.HasSuffix(string(content), "\n") {
+			sb.WriteString("\n")
+		}
+
+		for _, o := range orphans {
+			l, _ := commentSyntax.CommentLine(fmt.Sprintf("tpm-schematics orphan region %q: not declared by the template anymore", o.Name))
+			sb.WriteString(l)
+			sb.WriteString("\n")
+			for _, ol := range strings.Split(strings.TrimSuffix(o.Content, "\n"), "\n") {
+				l, _ = commentSyntax.CommentLine(ol)
+				sb.WriteString(l)
+				sb.WriteString("\n")
+			}
+		}
+
+		return []byte(sb.String()), sidecar, out, nil
+	default:
+		// the sidecar file can be read back with ReadRegionsFromBuffer: the regions saved by the previous runs are kept.
+		sidecar.Path = filepath.Join(filepath.Dir(targetPath), filepath.Base(targetPath)+".orphans")
+
+		var sb strings.Builder
+		saved := map[string]RegionInfo{}
+		if cfg.writer.FileExists(sidecar.Path) {
+			b, err := cfg.writer.ReadFile(sidecar.Path)
+			if err == nil {
+				saved, err = ReadRegionsFromBuffer(b)
+			}
+
+			if err != nil {
+				log.Error().Err(err).Str("orphans-file", sidecar.Path).Msg(semLogContext)
+				return content, OpNode{}, out, err
+			}
+
+			sb.Write(b)
+			if len(b) > 0 && !strings.HasSuffix(string(b), "\n") {
+				sb.WriteString("\n")
+			}
+		}
+
+		for _, o := range orphans {
+			if r, ok := saved[o.Name]; ok {
+				if r.Content == o.Content {
+					continue
+				}
+
+				err := fmt.Errorf("%w in %s: region %q already saved in %s with a different content", ErrOrphanRegions, targetPath, o.Name, sidecar.Path)
+				log.Error().Err(err).Msg(semLogContext)
+				return content, OpNode{}, out, err
+			}
+
+			sb.WriteString(fmt.Sprintf("@tpm-schematics:start-region(%q)\n", o.Name))
+			sb.WriteString(o.Content)
+			sb.WriteString(fmt.Sprintf("@tpm-schematics:end-region(%q)\n", o.Name))
+		}
+
+		sidecar.Content = []byte(sb.String())
+		log.Info().Str("orphans-file", sidecar.Path).Msg(semLogContext)
+		for i := range out {
+			out[i].Sidecar = sidecar.Path
+		}
+
+		return content, sidecar, out, nil
+	}
+}
+
+// newApplyFileResult reports the action planned for a target. generated is the output of the template while content is what is
+// going to be written after the recovery of the regions and the merges.
+func newApplyFileResult(cfg *ApplyOptions, action PlannedAction, rule string, exists bool, generated []byte, content []byte) (ApplyFileResult, error) {
+	const semLogContext = "schematics::new-apply-file-result"
+
+	res := ApplyFileResult{Path: action.Path, Action: action.Action, ConflictMode: action.ConflictMode, ConflictRule: rule, Size: len(content)}
+	for _, w := range action.Writes {
+		if w.Path != action.Path {
+			res.Artifacts = append(res.Artifacts, w.Path)
+		}
+	}
+
+	var current []byte
+	if exists {
+		var err error
+		current, err = cfg.writer.ReadFile(action.Path)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return res, err
+		}
+
+		res.PreviousSize = len(current)
+		if mf, ok := cfg.previousManifest.File(relativeTargetPath(cfg.writer.TargetFolder(), action.Path)); ok {
+			res.Modified = contentHash(current) != mf.Hash
+		}
+		res.RecoveredRegions = recoveredRegionsOfFile(cfg, action.Path, current, generated, content)
+	}
+
+	res.LinesAdded, res.LinesRemoved = lineDiffStats(action.Path, current, content)
+	return res, nil
+}
+
+// recoveredRegionsOfFile returns the regions of content that come from the current file: the ones with a content of their own
+// in the current file that differs from the template default.
+func recoveredRegionsOfFile(cfg *ApplyOptions, targetPath string, current []byte, generated []byte, content []byte) []string {
+	const semLogContext = "schematics::recovered-regions-of-file"
+
+	opts := append([]RegionOption{WithRegionFileName(targetPath)}, cfg.regionOptions()...)
+	currentRegs, err := ReadRegionsFromBuffer(current, opts...)
+	if err == nil {
+		currentRegs, _ = MigrateRegions(currentRegs, cfg.regionMigrations)
+	}
+
+	var generatedRegs, regs map[string]RegionInfo
+	if err == nil {
+		generatedRegs, err = ReadRegionsFromBuffer(generated, opts...)
+	}
+
+	if err == nil {
+		regs, err = ReadRegionsFromBuffer(content, opts...)
+	}
+
+	if err != nil {
+		// the report is best effort: the content has already been produced.
+		log.Warn().Err(err).Str("path", targetPath).Msg(semLogContext)
+		return nil
+	}
+
+	var names []string
+	for n, r := range regs {
+		if c, ok := currentRegs[n]; ok && c.OwnSize != 0 && r.Content != generatedRegs[n].Content {
+			names = append(names, n)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// lineDiffStats returns the number of lines added and removed going from current to content.
+func lineDiffStats(fn string, current []byte, content []byte) (int, int) {
+	if bytes.Equal(current, content) {
+		return 0, 0
+	}
+
+	var added, removed int
+	inHunk := false
+	for _, l := range strings.Split(godiffpatch.GeneratePatch(fn, string(current), string(content)), "\n") {
+		switch {
+		case strings.HasPrefix(l, "@@"):
+			inHunk = true
+		case !inHunk:
+		case strings.HasPrefix(l, "+"):
+			added++
+		case strings.HasPrefix(l, "-"):
+			removed++
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,140 @@
+package schematics
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// ConflictPolicyRule selects the conflict mode of the files whose path, relative to the target folder, matches one of the Include
+// globs and none of the Exclude ones. The globs follow the github.com/bmatcuk/doublestar syntax: '**' matches any number of folders,
+// '*', '?' and '[...]' match within a path segment and '{a,b}' lists alternatives. The rules are checked by decreasing Priority and,
+// with the same priority, in order of declaration.
+type ConflictPolicyRule struct {
+	Name     string   `yaml:"name,omitempty" mapstructure:"name,omitempty" json:"name,omitempty"`
+	Mode     string   `yaml:"mode,omitempty" mapstructure:"mode,omitempty" json:"mode,omitempty"`
+	Priority int      `yaml:"priority,omitempty" mapstructure:"priority,omitempty" json:"priority,omitempty"`
+	Include  []string `yaml:"include,omitempty" mapstructure:"include,omitempty" json:"include,omitempty"`
+	Exclude  []string `yaml:"exclude,omitempty" mapstructure:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// ConflictPolicyConfig is the content of a project conflict policy file.
+type ConflictPolicyConfig struct {
+	DefaultMode string               `yaml:"default-mode,omitempty" mapstructure:"default-mode,omitempty" json:"default-mode,omitempty"`
+	Rules       []ConflictPolicyRule `yaml:"rules,omitempty" mapstructure:"rules,omitempty" json:"rules,omitempty"`
+}
+
+// LoadConflictPolicyConfig reads a YAML (or JSON) conflict policy file and validates its globs.
+func LoadConflictPolicyConfig(fn string) (ConflictPolicyConfig, error) {
+	const semLogContext = "schematics::load-conflict-policy-config"
+
+	var cfg ConflictPolicyConfig
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return cfg, err
+	}
+
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		log.Error().Err(err).Str("file-name", fn).Msg(semLogContext)
+		return cfg, err
+	}
+
+	for _, r := range cfg.Rules {
+		for _, g := range append(append([]string{}, r.Include...), r.Exclude...) {
+			if !doublestar.ValidatePattern(g) {
+				err = fmt.Errorf("invalid glob %q in conflict rule %q: %w", g, r.Name, doublestar.ErrBadPattern)
+				log.Error().Err(err).Str("file-name", fn).Msg(semLogContext)
+				return cfg, err
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// ResolveConflictMode returns the conflict mode the options select for an existing file whose path is relative to the target
+// folder, together with the rule that selected it: the name of the rule (or the matching pattern) or ConflictRuleDefault.
+func ResolveConflictMode(relPath string, opts ...ApplyOption) (string, string, error) {
+	cfg := ApplyOptions{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	mode, rule, ok, err := cfg.matchConflictPolicy(relPath)
+	if err != nil || ok {
+		return mode, rule, err
+	}
+
+	return cfg.defaultConflictMode, ConflictRuleDefault, nil
+}
+
+// matchConflictPolicy returns the mode and the name of the first policy matching the relative path.
+func (cfg *ApplyOptions) matchConflictPolicy(relPath string) (string, string, bool, error) {
+	relPath = filepath.ToSlash(relPath)
+
+	policies := make([]ConflictPolicy, len(cfg.onConflictPolicies))
+	copy(policies, cfg.onConflictPolicies)
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].priority > policies[j].priority
+	})
+
+	for _, p := range policies {
+		rule, ok, err := p.match(relPath)
+		if err != nil || ok {
+			return p.mode, rule, ok, err
+		}
+	}
+
+	return "", "", false, nil
+}
+
+// match reports if the policy applies to the relative path. The returned rule is the name of the policy or, if not set, the
+// pattern that matched.
+func (p ConflictPolicy) match(relPath string) (string, bool, error) {
+	for _, g := range p.excludeGlobs {
+		ok, err := doublestar.Match(g, relPath)
+		if err != nil || ok {
+			return "", false, err
+		}
+	}
+
+	rule := ""
+	for _, r := range p.includeList {
+		if r.MatchString(path.Base(relPath)) {
+			rule = r.String()
+			break
+		}
+	}
+
+	for _, g := range p.includeGlobs {
+		if rule != "" {
+			break
+		}
+
+		ok, err := doublestar.Match(g, relPath)
+		if err != nil {
+			return "", false, err
+		}
+
+		if ok {
+			rule = g
+		}
+	}
+
+	if rule == "" {
+		return "", false, nil
+	}
+
+	if p.name != "" {
+		rule = p.name
+	}
+
+	return rule, true, nil
+}
@@ -0,0 +1,68 @@
+package schematics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictPolicies(t *testing.T) {
+
+	cfgFile := filepath.Join(t.TempDir(), ".tpm-schematics-policies.yml")
+	require.NoError(t, os.WriteFile(cfgFile, []byte(`
+default-mode: backup
+rules:
+  - name: docs
+    mode: keep
+    include: ["docs/**", "**/*.{md,txt}"]
+    exclude: ["docs/generated/**"]
+  - name: config
+    mode: merge
+    priority: 10
+    include: ["**/config/*.yml"]
+`), os.ModePerm))
+
+	cfg, err := schematics.LoadConflictPolicyConfig(cfgFile)
+	require.NoError(t, err)
+
+	opts := []schematics.ApplyOption{
+		schematics.WithApplyConflictPolicyConfig(cfg),
+		schematics.WithApplyConflictPolicy(schematics.ConflictModeNew, []string{`\.go$`}),
+	}
+
+	for _, tc := range []struct {
+		path string
+		mode string
+		rule string
+	}{
+		{"README.md", schematics.ConflictModeKeep, "docs"},
+		{"docs/guide/index.html", schematics.ConflictModeKeep, "docs"},
+		{"docs/generated/api.html", schematics.ConflictModeBackup, schematics.ConflictRuleDefault},
+		{"docs/config/app.yml", schematics.ConflictModeMerge, "config"},
+		{"pkg/main.go", schematics.ConflictModeNew, `\.go$`},
+		{"pkg/main.java", schematics.ConflictModeBackup, schematics.ConflictRuleDefault},
+	} {
+		mode, rule, err := schematics.ResolveConflictMode(tc.path, opts...)
+		require.NoError(t, err)
+		require.Equal(t, tc.mode, mode, tc.path)
+		require.Equal(t, tc.rule, rule, tc.path)
+	}
+
+	// the rule is reported in the apply result.
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/docs/README.md", []byte("user content\n"))
+	res, err := schematics.Apply([]schematics.OpNode{schematics.NewOpNode("docs/README.md", []byte("generated\n"))}, append(opts, schematics.WithStore(store))...)
+	require.NoError(t, err)
+	require.Equal(t, "docs", res.Files[0].ConflictRule)
+	require.Equal(t, schematics.PlanActionKeep, res.Files[0].Action)
+
+	// invalid globs are rejected, whatever the segment they are in.
+	for _, g := range []string{"[a-", "docs/[a-"} {
+		require.NoError(t, os.WriteFile(cfgFile, []byte("rules:\n  - include: [\""+g+"\"]\n"), os.ModePerm))
+		_, err = schematics.LoadConflictPolicyConfig(cfgFile)
+		require.Error(t, err, g)
+	}
+}
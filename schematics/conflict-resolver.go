@@ -0,0 +1,135 @@
+package schematics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	godiffpatch "github.com/sourcegraph/go-diff-patch"
+)
+
+var (
+	ErrConflictResolutionAborted = errors.New("conflict resolution aborted")
+	ErrUnknownConflictMode       = errors.New("unknown conflict mode")
+)
+
+// ConflictResolution is the decision of a ConflictResolver. With ApplyToAll the mode is used for all the remaining conflicts
+// without asking the resolver anymore.
+type ConflictResolution struct {
+	Mode       string
+	ApplyToAll bool
+}
+
+// ConflictResolver decides the conflict mode of an existing file whose content differs from the generated one. proposedMode is
+// the mode selected by the conflict policies; currentContent and generatedContent are the existing file and the content that
+// would be written (regions already recovered).
+type ConflictResolver interface {
+	ResolveConflict(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (ConflictResolution, error)
+}
+
+// ConflictResolverFunc adapts a function to the ConflictResolver interface.
+type ConflictResolverFunc func(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (ConflictResolution, error)
+
+func (f ConflictResolverFunc) ResolveConflict(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (ConflictResolution, error) {
+	return f(targetPath, currentContent, generatedContent, proposedMode)
+}
+
+// TerminalConflictResolver asks, for each conflicting file, what to do. The answers are the first letter of a conflict mode (overwrite,
+// keep, backup, new, merge): in upper case the mode applies to all the remaining files. 'd' shows the diff, 'q' aborts and an empty
+// answer accepts the proposed mode.
+type TerminalConflictResolver struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func NewTerminalConflictResolver(in io.Reader, out io.Writer) *TerminalConflictResolver {
+	return &TerminalConflictResolver{in: bufio.NewReader(in), out: out}
+}
+
+var terminalConflictResolverAnswers = map[string]string{
+	"o": ConflictModeOverwrite,
+	"k": ConflictModeKeep,
+	"b": ConflictModeBackup,
+	"n": ConflictModeNew,
+	"m": ConflictModeMerge,
+}
+
+func (r *TerminalConflictResolver) ResolveConflict(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (ConflictResolution, error) {
+	const semLogContext = "schematics::terminal-conflict-resolver"
+
+	for {
+		_, _ = fmt.Fprintf(r.out, "conflict on %s: [o]verwrite, [k]eep, [b]ackup, [n]ew, [m]erge, [d]iff, [q]uit (upper case for all remaining, default %s)? ", targetPath, proposedMode)
+		answer, err := r.in.ReadString('\n')
+		if err != nil && (err != io.EOF || answer == "") {
+			log.Error().Err(err).Msg(semLogContext)
+			return ConflictResolution{}, err
+		}
+
+		answer = strings.TrimSpace(answer)
+		switch lower := strings.ToLower(answer); lower {
+		case "":
+			return ConflictResolution{Mode: proposedMode}, nil
+		case "d":
+			_, _ = fmt.Fprintln(r.out, godiffpatch.GeneratePatch(targetPath, string(currentContent), string(generatedContent)))
+		case "q":
+			return ConflictResolution{}, ErrConflictResolutionAborted
+		default:
+			if m, ok := terminalConflictResolverAnswers[lower]; ok {
+				return ConflictResolution{Mode: m, ApplyToAll: answer != lower}, nil
+			}
+
+			_, _ = fmt.Fprintf(r.out, "invalid answer %q\n", answer)
+		}
+	}
+}
+
+// resolveConflictOfFile asks the resolver the conflict mode of an existing target. The resolver is not asked if the content does not
+// change or a previous answer applies to all the files. The bool reports that the mode comes from the resolver.
+func resolveConflictOfFile(cfg *ApplyOptions, targetPath string, content []byte, cm string) (string, bool, error) {
+	const semLogContext = "schematics::resolve-conflict-of-file"
+
+	if cfg.conflictResolver == nil {
+		return cm, false, nil
+	}
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return cm, false, err
+	}
+
+	if bytes.Equal(current, content) {
+		return cm, false, nil
+	}
+
+	if cfg.conflictResolution != nil {
+		return cfg.conflictResolution.Mode, true, nil
+	}
+
+	res, err := cfg.conflictResolver.ResolveConflict(targetPath, current, content, cm)
+	if err != nil {
+		log.Error().Err(err).Str("path", targetPath).Msg(semLogContext)
+		return cm, false, err
+	}
+
+	switch res.Mode {
+	case "":
+		res.Mode = cm
+	case ConflictModeOverwrite, ConflictModeKeep, ConflictModeBackup, ConflictModeNew, ConflictModeMerge:
+	default:
+		err = fmt.Errorf("%w %q chosen for %s", ErrUnknownConflictMode, res.Mode, targetPath)
+		log.Error().Err(err).Msg(semLogContext)
+		return cm, false, err
+	}
+
+	if res.ApplyToAll {
+		cfg.conflictResolution = &res
+	}
+
+	log.Info().Str("path", targetPath).Str("proposed-mode", cm).Str("mode", res.Mode).Msg(semLogContext)
+	return res.Mode, true, nil
+}
@@ -0,0 +1,96 @@
+package schematics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictResolver(t *testing.T) {
+
+	src := []schematics.OpNode{
+		schematics.NewOpNode("a.txt", []byte("generated a\n")),
+		schematics.NewOpNode("b.txt", []byte("generated b\n")),
+		schematics.NewOpNode("c.txt", []byte("generated c\n")),
+		schematics.NewOpNode("d.txt", []byte("unchanged\n")),
+	}
+
+	newStore := func() *schematics.ApplyMemoryStore {
+		store := schematics.NewApplyMemoryStore("/tmp")
+		_ = store.WriteFile("/tmp/a.txt", []byte("user a\n"))
+		_ = store.WriteFile("/tmp/b.txt", []byte("user b\n"))
+		_ = store.WriteFile("/tmp/c.txt", []byte("user c\n"))
+		_ = store.WriteFile("/tmp/d.txt", []byte("unchanged\n"))
+		return store
+	}
+
+	// the resolver is asked only for the files that change.
+	var asked []string
+	resolver := schematics.ConflictResolverFunc(func(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (schematics.ConflictResolution, error) {
+		asked = append(asked, targetPath)
+		require.Equal(t, schematics.ConflictModeBackup, proposedMode)
+		if targetPath == "/tmp/a.txt" {
+			return schematics.ConflictResolution{Mode: schematics.ConflictModeOverwrite}, nil
+		}
+
+		return schematics.ConflictResolution{Mode: schematics.ConflictModeKeep, ApplyToAll: true}, nil
+	})
+
+	store := newStore()
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeBackup), schematics.WithApplyConflictResolver(resolver))
+	require.NoError(t, err)
+	require.Equal(t, []string{"/tmp/a.txt", "/tmp/b.txt"}, asked)
+
+	actions := make(map[string]string)
+	for _, f := range res.Files {
+		actions[f.Path] = f.Action
+	}
+	require.Equal(t, map[string]string{"/tmp/a.txt": schematics.PlanActionOverwrite, "/tmp/b.txt": schematics.PlanActionKeep, "/tmp/c.txt": schematics.PlanActionKeep, "/tmp/d.txt": schematics.PlanActionUnchanged}, actions)
+	require.Equal(t, schematics.ConflictRuleResolver, res.Files[2].ConflictRule)
+
+	b, err := store.ReadFile("/tmp/c.txt")
+	require.NoError(t, err)
+	require.Equal(t, "user c\n", string(b))
+
+	// the terminal resolver: diff, then new for this file, then overwrite for all the remaining ones.
+	var out bytes.Buffer
+	store = newStore()
+	res, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyConflictResolver(schematics.NewTerminalConflictResolver(strings.NewReader("d\nn\nx\nO\n"), &out)))
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "+generated a")
+	require.Contains(t, out.String(), "invalid answer \"x\"")
+	require.True(t, store.FileExists("/tmp/a.txt.new"))
+	require.Equal(t, schematics.PlanActionOverwrite, res.Files[2].Action)
+
+	_, err = schematics.Apply(src, schematics.WithStore(newStore()), schematics.WithApplyConflictResolver(schematics.NewTerminalConflictResolver(strings.NewReader("q\n"), &out)))
+	require.ErrorIs(t, err, schematics.ErrConflictResolutionAborted)
+
+	// the shadow copies are not saved just because a resolver is set.
+	for f := range store.Files() {
+		require.NotContains(t, f, schematics.ShadowFolder)
+	}
+
+	// a merge chosen in the resolver has the base saved by the previous generation when the shadow folder is set.
+	store = schematics.NewApplyMemoryStore("/tmp")
+	mergeResolver := schematics.NewTerminalConflictResolver(strings.NewReader("m\n"), &out)
+	_, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("m.txt", []byte("a\nb\nc\n"))}, schematics.WithStore(store), schematics.WithApplyConflictResolver(mergeResolver), schematics.WithApplyShadowFolder(schematics.ShadowFolder))
+	require.NoError(t, err)
+
+	_ = store.WriteFile("/tmp/m.txt", []byte("user\nb\nc\n"))
+	res, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("m.txt", []byte("a\nb\ngenerated\n"))}, schematics.WithStore(store), schematics.WithApplyConflictResolver(mergeResolver))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionMerge, res.Files[0].Action)
+	require.Equal(t, "user\nb\ngenerated\n", string(store.Files()["/tmp/m.txt"]))
+
+	// the merged file keeps its base up to date.
+	require.Equal(t, "a\nb\ngenerated\n", string(store.Files()["/tmp/"+schematics.ShadowFolder+"/m.txt"]))
+
+	// a mode unknown to Apply is an error.
+	_, err = schematics.Apply(src, schematics.WithStore(newStore()), schematics.WithApplyConflictResolver(schematics.ConflictResolverFunc(func(targetPath string, currentContent []byte, generatedContent []byte, proposedMode string) (schematics.ConflictResolution, error) {
+		return schematics.ConflictResolution{Mode: "replace"}, nil
+	})))
+	require.ErrorIs(t, err, schematics.ErrUnknownConflictMode)
+}
@@ -0,0 +1,246 @@
+package schematics
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// StagingFolderPrefix is the prefix of the temporary folder, created under the target folder, where the transactions of the
+// ApplyFileStore stage the new files and keep the replaced ones until the commit is complete.
+const StagingFolderPrefix = ".tpm-schematics-tx-"
+
+const (
+	fileTransactionOpWrite  = "write"
+	fileTransactionOpRemove = "remove"
+	fileTransactionOpRename = "rename"
+)
+
+type fileTransactionOp struct {
+	kind   string
+	path   string
+	moveTo string
+	staged string
+}
+
+// applyFileTransaction writes the files in a staging folder and moves them in place on Commit. Every step of the commit records how
+// to undo it so that a failure restores the files replaced, removed or moved and deletes the folders created.
+type applyFileTransaction struct {
+	store       *ApplyFileStore
+	stagingDir  string
+	ops         []fileTransactionOp
+	undo        []func() error
+	createdDirs []string
+	seq         int
+}
+
+// BeginTransaction returns a transaction staging the changes in a temporary folder of the target folder (that is created if missing):
+// being on the same file system the staged files are moved in place with atomic renames.
+func (fw *ApplyFileStore) BeginTransaction() (ApplyTransaction, error) {
+	const semLogContext = "apply-file-store::begin-transaction"
+
+	tx := &applyFileTransaction{store: fw}
+	if err := tx.mkdirAll(fw.targetFolder); err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(fw.targetFolder, StagingFolderPrefix)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		tx.removeCreatedDirs()
+		return nil, err
+	}
+
+	tx.stagingDir = dir
+	return tx, nil
+}
+
+func (tx *applyFileTransaction) WriteFile(fn string, p []byte) error {
+	staged := tx.stagingPath("new")
+	if err := os.WriteFile(staged, p, fs.ModePerm); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, fileTransactionOp{kind: fileTransactionOpWrite, path: fn, staged: staged})
+	return nil
+}
+
+func (tx *applyFileTransaction) RemoveFile(fn string) error {
+	tx.ops = append(tx.ops, fileTransactionOp{kind: fileTransactionOpRemove, path: fn})
+	return nil
+}
+
+func (tx *applyFileTransaction) RenameFile(fromFile string, toFile string) error {
+	tx.ops = append(tx.ops, fileTransactionOp{kind: fileTransactionOpRename, path: fromFile, moveTo: toFile})
+	return nil
+}
+
+// Commit moves the staged changes in place. On failure the steps already done are undone.
+func (tx *applyFileTransaction) Commit() error {
+	const semLogContext = "apply-file-store::commit"
+
+	for _, op := range tx.ops {
+		if err := tx.commitOp(op); err != nil {
+			log.Error().Err(err).Str("file-name", op.path).Str("op", op.kind).Msg(semLogContext)
+			if rbErr := tx.Rollback(); rbErr != nil {
+				err = errors.Join(err, rbErr)
+			}
+
+			return err
+		}
+	}
+
+	tx.undo = nil
+	for _, op := range tx.ops {
+		if op.kind != fileTransactionOpWrite {
+			tx.store.removeEmptyFolders(filepath.Dir(op.path))
+		}
+	}
+
+	if err := os.RemoveAll(tx.stagingDir); err != nil {
+		log.Warn().Err(err).Str("dir", tx.stagingDir).Msg(semLogContext + " - staging folder not removed")
+	}
+
+	return nil
+}
+
+// Rollback undoes the steps of the commit in reverse order and removes the folders created by the transaction. If a step cannot be
+// undone the staging folder, that holds the replaced files, is kept.
+func (tx *applyFileTransaction) Rollback() error {
+	const semLogContext = "apply-file-store::rollback"
+
+	var errs []error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			errs = append(errs, err)
+		}
+	}
+	tx.undo = nil
+
+	if len(errs) > 0 {
+		log.Error().Str("dir", tx.stagingDir).Msg(semLogContext + " - rollback incomplete, the replaced files are kept in the staging folder")
+		return errors.Join(errs...)
+	}
+
+	if err := os.RemoveAll(tx.stagingDir); err != nil {
+		log.Warn().Err(err).Str("dir", tx.stagingDir).Msg(semLogContext + " - staging folder not removed")
+	}
+
+	tx.removeCreatedDirs()
+	return nil
+}
+
+func (tx *applyFileTransaction) commitOp(op fileTransactionOp) error {
+	switch op.kind {
+	case fileTransactionOpWrite:
+		if err := tx.mkdirAll(filepath.Dir(op.path)); err != nil {
+			return err
+		}
+
+		// the rename would replace the mode of the existing file: it's kept like os.WriteFile does.
+		if fi, err := os.Stat(op.path); err == nil {
+			if err = os.Chmod(op.staged, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.backup(op.path); err != nil {
+			return err
+		}
+
+		if err := os.Rename(op.staged, op.path); err != nil {
+			return err
+		}
+
+		tx.undo = append(tx.undo, func() error {
+			return os.Remove(op.path)
+		})
+	case fileTransactionOpRemove:
+		if !fileutil.FileExists(op.path) {
+			return fmt.Errorf("file not found: %s", op.path)
+		}
+
+		return tx.backup(op.path)
+	case fileTransactionOpRename:
+		if err := tx.mkdirAll(filepath.Dir(op.moveTo)); err != nil {
+			return err
+		}
+
+		if err := tx.backup(op.moveTo); err != nil {
+			return err
+		}
+
+		if err := os.Rename(op.path, op.moveTo); err != nil {
+			return err
+		}
+
+		tx.undo = append(tx.undo, func() error {
+			return os.Rename(op.moveTo, op.path)
+		})
+	}
+
+	return nil
+}
+
+// backup moves an existing file to the staging folder so that it can be restored by the rollback.
+func (tx *applyFileTransaction) backup(fn string) error {
+	if !fileutil.FileExists(fn) {
+		return nil
+	}
+
+	bak := tx.stagingPath("bak")
+	if err := os.Rename(fn, bak); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return os.Rename(bak, fn)
+	})
+
+	return nil
+}
+
+func (tx *applyFileTransaction) stagingPath(kind string) string {
+	tx.seq++
+	return filepath.Join(tx.stagingDir, fmt.Sprintf("%d.%s", tx.seq, kind))
+}
+
+// mkdirAll creates the missing folders of the path and records them to be removed by the rollback.
+func (tx *applyFileTransaction) mkdirAll(dir string) error {
+	var missing []string
+	for d := filepath.Clean(dir); !fileutil.FileExists(d); d = filepath.Dir(d) {
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], fs.ModePerm); err != nil {
+			return err
+		}
+
+		tx.createdDirs = append(tx.createdDirs, missing[i])
+	}
+
+	return nil
+}
+
+func (tx *applyFileTransaction) removeCreatedDirs() {
+	const semLogContext = "apply-file-store::remove-created-dirs"
+
+	for i := len(tx.createdDirs) - 1; i >= 0; i-- {
+		if err := os.Remove(tx.createdDirs[i]); err != nil {
+			log.Warn().Err(err).Str("dir", tx.createdDirs[i]).Msg(semLogContext)
+		}
+	}
+
+	tx.createdDirs = nil
+}
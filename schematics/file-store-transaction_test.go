@@ -0,0 +1,91 @@
+package schematics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecutePlanTransaction(t *testing.T) {
+
+	targetFolder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(targetFolder, "a.txt"), []byte("user a\n"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(targetFolder, "old.txt"), []byte("old\n"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(targetFolder, "blocker"), []byte("a file\n"), os.ModePerm))
+
+	// the last write fails since its folder would be under a file: the previous changes are rolled back.
+	plan := schematics.ApplyPlan{Actions: []schematics.PlannedAction{
+		{Path: filepath.Join(targetFolder, "a.txt"), Action: schematics.PlanActionOverwrite, Writes: []schematics.OpNode{{Path: filepath.Join(targetFolder, "a.txt"), Content: []byte("generated a\n")}}},
+		{Path: filepath.Join(targetFolder, "pkg", "sub", "b.txt"), Action: schematics.PlanActionCreate, Writes: []schematics.OpNode{{Path: filepath.Join(targetFolder, "pkg", "sub", "b.txt"), Content: []byte("generated b\n")}}},
+		{Path: filepath.Join(targetFolder, "old.txt"), Action: schematics.PlanActionDelete},
+		{Path: filepath.Join(targetFolder, "blocker", "c.txt"), Action: schematics.PlanActionCreate, Writes: []schematics.OpNode{{Path: filepath.Join(targetFolder, "blocker", "c.txt"), Content: []byte("generated c\n")}}},
+	}}
+
+	_, err := schematics.ExecutePlan(plan, schematics.WithFilesystemStore(targetFolder))
+	require.Error(t, err)
+
+	b, err := os.ReadFile(filepath.Join(targetFolder, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "user a\n", string(b))
+	require.FileExists(t, filepath.Join(targetFolder, "old.txt"))
+	require.NoDirExists(t, filepath.Join(targetFolder, "pkg"))
+
+	entries, err := os.ReadDir(targetFolder)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// without the failing write the changes are committed and the staging folder removed.
+	plan.Actions = plan.Actions[:3]
+	_, err = schematics.ExecutePlan(plan, schematics.WithFilesystemStore(targetFolder))
+	require.NoError(t, err)
+
+	b, err = os.ReadFile(filepath.Join(targetFolder, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "generated a\n", string(b))
+	require.FileExists(t, filepath.Join(targetFolder, "pkg", "sub", "b.txt"))
+	require.NoFileExists(t, filepath.Join(targetFolder, "old.txt"))
+
+	entries, err = os.ReadDir(targetFolder)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// the replaced files keep their mode.
+	script := filepath.Join(targetFolder, "run.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0700))
+	require.NoError(t, os.Chmod(script, 0700))
+	_, err = schematics.ExecutePlan(schematics.ApplyPlan{Actions: []schematics.PlannedAction{
+		{Path: script, Action: schematics.PlanActionOverwrite, Writes: []schematics.OpNode{{Path: script, Content: []byte("#!/bin/sh\necho generated\n")}}},
+	}}, schematics.WithFilesystemStore(targetFolder))
+	require.NoError(t, err)
+
+	fi, err := os.Stat(script)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	// a new target folder is removed as well by the rollback.
+	newTargetFolder := filepath.Join(t.TempDir(), "project")
+	plan = schematics.ApplyPlan{Actions: []schematics.PlannedAction{
+		{Path: filepath.Join(newTargetFolder, "a.txt"), Action: schematics.PlanActionCreate, Writes: []schematics.OpNode{{Path: filepath.Join(newTargetFolder, "a.txt"), Content: []byte("generated a\n")}}},
+		{Path: filepath.Join(newTargetFolder, "missing.txt"), Action: schematics.PlanActionDelete},
+	}}
+
+	_, err = schematics.ExecutePlan(plan, schematics.WithFilesystemStore(newTargetFolder))
+	require.Error(t, err)
+	require.NoDirExists(t, newTargetFolder)
+
+	// the memory store is left untouched on failure.
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/a.txt", []byte("user a\n"))
+	_, err = schematics.ExecutePlan(schematics.ApplyPlan{Actions: []schematics.PlannedAction{
+		{Path: "/tmp/a.txt", Action: schematics.PlanActionOverwrite, Writes: []schematics.OpNode{{Path: "/tmp/a.txt", Content: []byte("generated a\n")}}},
+		{Path: "/tmp/missing.txt", Action: schematics.PlanActionDelete},
+	}}, schematics.WithStore(store))
+	require.Error(t, err)
+
+	b, err = store.ReadFile("/tmp/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "user a\n", string(b))
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util/fileutil"
 	"github.com/rs/zerolog/log"
@@ -59,7 +60,7 @@ func (fw *ApplyFileStore) ListFilenames(rexp *regexp.Regexp) (map[string]struct{
 	return m, nil
 }
 
-func (fw *ApplyFileStore) RecoverRegionsOfFile(fromFile string, toContent []byte) ([]byte, error) {
+func (fw *ApplyFileStore) RecoverRegionsOfFile(fromFile string, toContent []byte, opts ...RegionOption) ([]byte, error) {
 	if !fileutil.FileExists(fromFile) {
 		return toContent, nil
 	}
@@ -69,9 +70,55 @@ func (fw *ApplyFileStore) RecoverRegionsOfFile(fromFile string, toContent []byte
 		return nil, err
 	}
 
-	return RecoverRegions(b, toContent)
+	return RecoverRegions(b, toContent, append([]RegionOption{WithRegionFileName(fromFile)}, opts...)...)
 }
 
 func (fw *ApplyFileStore) ReadFile(fn string) ([]byte, error) {
 	return os.ReadFile(fn)
 }
+
+// RemoveFile deletes the file and the folders left empty up to the target folder.
+func (fw *ApplyFileStore) RemoveFile(fn string) error {
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+
+	fw.removeEmptyFolders(filepath.Dir(fn))
+	return nil
+}
+
+// RenameFile moves the file, creating the destination folder if needed, and removes the folders left empty up to the target folder.
+func (fw *ApplyFileStore) RenameFile(fromFile string, toFile string) error {
+	dir := filepath.Dir(toFile)
+	if !fileutil.FileExists(dir) {
+		err := os.MkdirAll(dir, fs.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(fromFile, toFile); err != nil {
+		return err
+	}
+
+	fw.removeEmptyFolders(filepath.Dir(fromFile))
+	return nil
+}
+
+func (fw *ApplyFileStore) removeEmptyFolders(dir string) {
+	const semLogContext = "apply-file-store::remove-empty-folders"
+
+	targetFolder := filepath.Clean(fw.targetFolder)
+	for dir = filepath.Clean(dir); dir != targetFolder && strings.HasPrefix(dir, targetFolder+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+
+		log.Trace().Str("dir", dir).Msg(semLogContext)
+		if err = os.Remove(dir); err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg(semLogContext)
+			return
+		}
+	}
+}
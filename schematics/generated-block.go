@@ -0,0 +1,71 @@
+package schematics
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	GeneratedBlockDemarcationStart = "start-generated"
+	GeneratedBlockDemarcationEnd   = "end-generated"
+)
+
+// GeneratedBlockSyntax matches the @tpm-schematics generated-block markers anywhere in a line. Generated blocks are the inverse of
+// regions: the file belongs to the user except for the blocks the generator keeps refreshing (i.e. in main.go or README.md).
+var GeneratedBlockSyntax = RegionSyntax{
+	Name:        "tpm-schematics-generated",
+	StartRegexp: regexp.MustCompile(`@tpm-schematics:` + GeneratedBlockDemarcationStart + `\("(?P<name>` + regionNamePattern + `)"\)`),
+	EndRegexp:   regexp.MustCompile(`@tpm-schematics:` + GeneratedBlockDemarcationEnd + `\("(?P<name>` + regionNamePattern + `)"\)`),
+}
+
+// HasGeneratedBlocks reports if p declares at least a generated block.
+func HasGeneratedBlocks(p []byte) bool {
+	return GeneratedBlockSyntax.StartRegexp.Match(p)
+}
+
+// RefreshGeneratedBlocks keeps fromContent, the user-owned file, and replaces the content of its generated blocks with the ones
+// rendered in toContent. The blocks rendered but not found in fromContent cannot be placed and are returned as missing.
+// The line ending style, the final newline state and the BOM of fromContent are preserved unless WithRegionTextFormat is used.
+func RefreshGeneratedBlocks(fromContent []byte, toContent []byte, opts ...RegionOption) ([]byte, []string, error) {
+	const semLogContext = "schematics::refresh-generated-blocks"
+
+	opts = append(opts, WithRegionSyntax(GeneratedBlockSyntax))
+	blocks, err := ReadRegionsFromBuffer(toContent, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, nil, err
+	}
+
+	contents := make(map[string]string, len(blocks))
+	for n, b := range blocks {
+		contents[n] = b.Content
+	}
+
+	b, replaced, err := ReplaceRegions(fromContent, contents, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, nil, err
+	}
+
+	var missing []string
+	for n, blk := range blocks {
+		if _, ok := replaced[n]; ok {
+			continue
+		}
+
+		// nested blocks are refreshed together with the enclosing one.
+		isNested := false
+		for p := blk.Parent; p != "" && !isNested; p = blocks[p].Parent {
+			_, isNested = replaced[p]
+		}
+
+		if !isNested {
+			missing = append(missing, n)
+		}
+	}
+
+	sort.Strings(missing)
+	return b, missing, nil
+}
@@ -0,0 +1,67 @@
+package schematics_test
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshGeneratedBlocks(t *testing.T) {
+
+	current := []byte(`# My service
+
+Written by the user.
+
+<!-- @tpm-schematics:start-generated("endpoints") -->
+- GET /v1/old
+<!-- @tpm-schematics:end-generated("endpoints") -->
+
+More user notes.
+`)
+
+	generated := []byte(`# Service
+
+<!-- @tpm-schematics:start-generated("endpoints") -->
+- GET /v1/items
+- POST /v1/items
+<!-- @tpm-schematics:end-generated("endpoints") -->
+
+<!-- @tpm-schematics:start-generated("config") -->
+- PORT
+<!-- @tpm-schematics:end-generated("config") -->
+`)
+
+	expected := `# My service
+
+Written by the user.
+
+<!-- @tpm-schematics:start-generated("endpoints") -->
+- GET /v1/items
+- POST /v1/items
+<!-- @tpm-schematics:end-generated("endpoints") -->
+
+More user notes.
+`
+
+	require.True(t, schematics.HasGeneratedBlocks(generated))
+
+	data, missing, err := schematics.RefreshGeneratedBlocks(current, generated)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+	require.Equal(t, []string{"config"}, missing)
+
+	src := []schematics.OpNode{schematics.NewOpNode("README.md", generated)}
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/README.md", current)
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.NoError(t, err)
+	require.Equal(t, expected, string(store.Files()["/tmp/README.md"]))
+
+	// a new file is created from the template.
+	store = schematics.NewApplyMemoryStore("/tmp")
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.NoError(t, err)
+	require.Equal(t, string(generated), string(store.Files()["/tmp/README.md"]))
+}
@@ -0,0 +1,356 @@
+package schematics
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MergeGoSource merges a Go file edited by the user with the newly generated one without relying on region markers.
+// The generated top level declarations (functions, methods, types, vars and consts) replace the ones of the current file while the
+// declarations that exist only in the current file are kept, as written, with their comments. The specs of a grouped declaration
+// (i.e. var (...)) are considered one by one. The init functions and the blank (_) values have no name: they are kept unless the
+// generated file has the same declaration. The imports of the current file not found in the generated one are added to the generated
+// import declaration, unless the merged file doesn't use them anymore.
+func MergeGoSource(currentContent []byte, generatedContent []byte) ([]byte, error) {
+	const semLogContext = "schematics::merge-go-source"
+
+	fset := token.NewFileSet()
+	current, err := parser.ParseFile(fset, "current.go", currentContent, parser.ParseComments)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	generated, err := parser.ParseFile(fset, "generated.go", generatedContent, parser.ParseComments)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	generatedKeys := make(map[string]struct{})
+	for _, d := range generated.Decls {
+		for _, k := range goDeclKeys(fset, d) {
+			generatedKeys[k] = struct{}{}
+		}
+	}
+
+	isUserKeys := func(keys []string) bool {
+		for _, k := range keys {
+			if _, ok := generatedKeys[k]; ok {
+				return false
+			}
+		}
+
+		return len(keys) > 0
+	}
+
+	generatedImports := make(map[string]struct{})
+	for _, is := range generated.Imports {
+		generatedImports[goImportKey(is)] = struct{}{}
+	}
+
+	var userImports []*ast.ImportSpec
+	for _, is := range current.Imports {
+		if _, ok := generatedImports[goImportKey(is)]; !ok {
+			userImports = append(userImports, is)
+		}
+	}
+
+	// the text of a declaration starts right after the previous one so that floating comments travel with it.
+	var userDecls []string
+	prevEnd := current.Name.End()
+	for _, d := range current.Decls {
+		start, end := prevEnd, d.End()
+		prevEnd = end
+
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			continue
+		}
+
+		if gd, ok := d.(*ast.GenDecl); ok && len(gd.Specs) > 1 {
+			var userSpecs []ast.Spec
+			for _, sp := range gd.Specs {
+				if isUserKeys(goSpecKeys(fset, sp)) {
+					userSpecs = append(userSpecs, sp)
+				}
+			}
+
+			if len(userSpecs) > 0 && len(userSpecs) < len(gd.Specs) {
+				// the block is shared with generated declarations: only the user specs are kept.
+				if decl, ok := goPartialGenDeclText(fset, currentContent, gd, userSpecs); ok {
+					userDecls = append(userDecls, decl)
+				}
+				continue
+			}
+		}
+
+		keys := goDeclKeys(fset, d)
+		if isUserKeys(keys) {
+			log.Trace().Strs("keys", keys).Msg(semLogContext + " - keeping user declaration")
+
+			// a trailing comment on the line of the previous declaration belongs to it.
+			startOffset, endOffset := fset.Position(start).Offset, fset.Position(end).Offset
+			if nl := bytes.IndexByte(currentContent[startOffset:endOffset], '\n'); nl >= 0 {
+				startOffset += nl + 1
+			}
+			userDecls = append(userDecls, strings.Trim(string(currentContent[startOffset:endOffset]), "\n"))
+		}
+	}
+
+	if len(userImports) == 0 && len(userDecls) == 0 {
+		return generatedContent, nil
+	}
+
+	var out bytes.Buffer
+	out.Write(generatedContent)
+	for _, d := range userDecls {
+		out.WriteString("\n\n")
+		out.WriteString(d)
+		out.WriteString("\n")
+	}
+
+	// the user imports no longer used, i.e. by a generated declaration that has been replaced, are dropped.
+	merged, err := parser.ParseFile(token.NewFileSet(), "merged.go", out.Bytes(), parser.SkipObjectResolution)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	usedNames := goSelectorNames(merged)
+	var imports []string
+	for _, is := range userImports {
+		if name, ok := goImportName(is); ok {
+			if _, used := usedNames[name]; !used {
+				log.Trace().Str("import", goImportKey(is)).Msg(semLogContext + " - dropping unused user import")
+				continue
+			}
+		}
+
+		imports = append(imports, goNodeText(fset, currentContent, is.Pos(), is.End()))
+	}
+
+	if len(imports) > 0 {
+		out = goAddImports(fset, generated, out.Bytes(), imports)
+	}
+
+	b, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// goAddImports adds the imports to the last import declaration of the generated file (the content starts with the generated
+// file). A new declaration is added after the package clause if the generated file has no imports.
+func goAddImports(fset *token.FileSet, generated *ast.File, content []byte, imports []string) bytes.Buffer {
+	var lastImport *ast.GenDecl
+	for _, d := range generated.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			lastImport = gd
+		}
+	}
+
+	var out bytes.Buffer
+	switch {
+	case lastImport == nil:
+		insertAt := fset.Position(generated.Name.End()).Offset
+		out.Write(content[:insertAt])
+		out.WriteString("\n\nimport (\n")
+		for _, is := range imports {
+			out.WriteString("\t" + is + "\n")
+		}
+		out.WriteString(")\n")
+		out.Write(content[insertAt:])
+	case lastImport.Lparen.IsValid():
+		insertAt := fset.Position(lastImport.Rparen).Offset
+		out.Write(content[:insertAt])
+		for _, is := range imports {
+			out.WriteString("\t" + is + "\n")
+		}
+		out.Write(content[insertAt:])
+	default:
+		// import "fmt" becomes a grouped declaration.
+		specStart, specEnd := fset.Position(lastImport.Specs[0].Pos()).Offset, fset.Position(lastImport.End()).Offset
+		out.Write(content[:specStart])
+		out.WriteString("(\n\t")
+		out.Write(content[specStart:specEnd])
+		out.WriteString("\n")
+		for _, is := range imports {
+			out.WriteString("\t" + is + "\n")
+		}
+		out.WriteString(")")
+		out.Write(content[specEnd:])
+	}
+
+	return out
+}
+
+// goImportName returns the name the import is referred with. The bool is false if the import cannot be told unused: blank and dot
+// imports or a package name that cannot be guessed from the path (i.e. github.com/org/go-lib).
+func goImportName(is *ast.ImportSpec) (string, bool) {
+	if is.Name != nil {
+		return is.Name.Name, is.Name.Name != "_" && is.Name.Name != "."
+	}
+
+	p, _ := strconv.Unquote(is.Path.Value)
+	elems := strings.Split(p, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		// major version suffix (i.e. github.com/org/lib/v2).
+		name = elems[len(elems)-2]
+	}
+
+	if ndx := strings.LastIndex(name, ".v"); ndx > 0 && len(name) > ndx+2 && strings.Trim(name[ndx+2:], "0123456789") == "" {
+		// gopkg.in style version suffix (i.e. gopkg.in/yaml.v3).
+		name = name[:ndx]
+	}
+
+	return name, token.IsIdentifier(name)
+}
+
+// goSelectorNames returns the identifiers used as qualifiers (the x of x.Sel): the package names in use are among them.
+func goSelectorNames(f *ast.File) map[string]struct{} {
+	names := make(map[string]struct{})
+	ast.Inspect(f, func(n ast.Node) bool {
+		if se, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := se.X.(*ast.Ident); ok {
+				names[id.Name] = struct{}{}
+			}
+		}
+		return true
+	})
+
+	return names
+}
+
+func goNodeText(fset *token.FileSet, src []byte, start token.Pos, end token.Pos) string {
+	return string(src[fset.Position(start).Offset:fset.Position(end).Offset])
+}
+
+func goImportKey(is *ast.ImportSpec) string {
+	p, _ := strconv.Unquote(is.Path.Value)
+	if is.Name != nil {
+		return is.Name.Name + " " + p
+	}
+
+	return p
+}
+
+// goDeclKeys returns the identities of the objects declared by d: func:Name, method:Recv.Name, type:Name, value:Name (vars and consts).
+// The declarations without a name (init functions and blank values) are identified by their text.
+func goDeclKeys(fset *token.FileSet, d ast.Decl) []string {
+	switch td := d.(type) {
+	case *ast.FuncDecl:
+		if td.Recv != nil && len(td.Recv.List) > 0 {
+			return []string{"method:" + goReceiverTypeName(td.Recv.List[0].Type) + "." + td.Name.Name}
+		}
+
+		if td.Name.Name == "init" {
+			return []string{"init:" + goPrintedNode(fset, td)}
+		}
+		return []string{"func:" + td.Name.Name}
+	case *ast.GenDecl:
+		var keys []string
+		for _, s := range td.Specs {
+			keys = append(keys, goSpecKeys(fset, s)...)
+		}
+		return keys
+	}
+
+	return nil
+}
+
+func goSpecKeys(fset *token.FileSet, s ast.Spec) []string {
+	switch ts := s.(type) {
+	case *ast.TypeSpec:
+		return []string{"type:" + ts.Name.Name}
+	case *ast.ValueSpec:
+		var keys []string
+		for _, n := range ts.Names {
+			if n.Name != "_" {
+				keys = append(keys, "value:"+n.Name)
+			}
+		}
+
+		if len(keys) == 0 {
+			return []string{"value:_:" + goPrintedNode(fset, ts)}
+		}
+		return keys
+	}
+
+	return nil
+}
+
+// goPrintedNode returns the node formatted without comments: two declarations with the same printed form are the same.
+func goPrintedNode(fset *token.FileSet, n ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, n); err != nil {
+		return ""
+	}
+
+	return buf.String()
+}
+
+// goPartialGenDeclText returns the text of a grouped declaration made of the given specs only. The consts with implicit values
+// (i.e. iota) depend on the previous specs and cannot be taken apart from the block: they are skipped with a warning. The bool is
+// false if no spec is left.
+func goPartialGenDeclText(fset *token.FileSet, src []byte, gd *ast.GenDecl, specs []ast.Spec) (string, bool) {
+	const semLogContext = "schematics::go-partial-gen-decl-text"
+
+	var lines []string
+	for _, s := range specs {
+		start, end := s.Pos(), s.End()
+		switch ts := s.(type) {
+		case *ast.TypeSpec:
+			if ts.Doc != nil {
+				start = ts.Doc.Pos()
+			}
+			if ts.Comment != nil {
+				end = ts.Comment.End()
+			}
+		case *ast.ValueSpec:
+			if gd.Tok == token.CONST && len(ts.Values) == 0 {
+				log.Warn().Strs("keys", goSpecKeys(fset, ts)).Msg(semLogContext + " - const with implicit value in a generated block cannot be kept, move it to its own declaration")
+				continue
+			}
+			if ts.Doc != nil {
+				start = ts.Doc.Pos()
+			}
+			if ts.Comment != nil {
+				end = ts.Comment.End()
+			}
+		}
+
+		lines = append(lines, "\t"+goNodeText(fset, src, start, end)+"\n")
+	}
+
+	if len(lines) == 0 {
+		return "", false
+	}
+
+	return gd.Tok.String() + " (\n" + strings.Join(lines, "") + ")", true
+}
+
+func goReceiverTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return goReceiverTypeName(t.X)
+	case *ast.IndexExpr:
+		return goReceiverTypeName(t.X)
+	case *ast.IndexListExpr:
+		return goReceiverTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+
+	return ""
+}
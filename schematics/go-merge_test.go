@@ -0,0 +1,219 @@
+package schematics_test
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+var goMergeCurrent = []byte(`package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Service is generated.
+type Service struct {
+	Name string
+}
+
+// Hello is generated but has been edited.
+func (s *Service) Hello() string {
+	return "edited"
+}
+
+// Upper has been added by the user.
+func (s *Service) Upper() string {
+	return strings.ToUpper(s.Name) // keep me
+}
+
+var userVar = fmt.Sprint("user")
+`)
+
+var goMergeGenerated = []byte(`package service
+
+import "fmt"
+
+// Service is generated.
+type Service struct {
+	Name string
+	Age  int
+}
+
+// Hello is generated.
+func (s *Service) Hello() string {
+	return fmt.Sprint("hello ", s.Name)
+}
+`)
+
+func TestMergeGoSource(t *testing.T) {
+	data, err := schematics.MergeGoSource(goMergeCurrent, goMergeGenerated)
+	require.NoError(t, err)
+
+	out := string(data)
+	t.Log(out)
+	require.Contains(t, out, "Age  int")
+	require.Contains(t, out, `return fmt.Sprint("hello ", s.Name)`)
+	require.NotContains(t, out, `"edited"`)
+	require.Contains(t, out, "// Upper has been added by the user.\nfunc (s *Service) Upper() string {\n\treturn strings.ToUpper(s.Name) // keep me\n}")
+	require.Contains(t, out, `var userVar = fmt.Sprint("user")`)
+	require.Contains(t, out, `"strings"`)
+}
+
+func TestApplyGoMergeMode(t *testing.T) {
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/service.go", goMergeCurrent)
+
+	_, err := schematics.Apply(
+		[]schematics.OpNode{schematics.NewOpNode("service.go", goMergeGenerated)},
+		schematics.WithStore(store),
+		schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite),
+		schematics.WithApplyMergeMode(schematics.MergeModeGoAST, ".go"))
+	require.NoError(t, err)
+	require.Contains(t, string(store.Files()["/tmp/service.go"]), "func (s *Service) Upper() string")
+}
+
+func TestMergeGoSourceUserDeclarations(t *testing.T) {
+
+	generated := []byte(`package main
+
+import "fmt"
+
+func init() {
+	fmt.Println("generated init")
+}
+
+var (
+	a = 1
+)
+
+func main() {
+	fmt.Println(a)
+}
+`)
+
+	// no user imports: the generated declarations must be kept.
+	current := []byte(`package main
+
+func main() {}
+
+func user() {}
+`)
+
+	data, err := schematics.MergeGoSource(current, generated)
+	require.NoError(t, err)
+	out := string(data)
+	require.Contains(t, out, "package main")
+	require.Contains(t, out, "fmt.Println(a)")
+	require.Contains(t, out, "func user() {}")
+
+	// the declarations without a name and the user specs of a block shared with generated ones.
+	current = []byte(`package main
+
+import "fmt"
+
+func init() {
+	fmt.Println("generated init")
+}
+
+func init() {
+	fmt.Println("user init")
+}
+
+var _ fmt.Stringer = (*T)(nil)
+
+type T struct{}
+
+func (t *T) String() string { return "t" }
+
+var (
+	a = 1
+	// b is added by the user.
+	b = 2
+)
+
+func main() {
+	fmt.Println(a)
+}
+`)
+
+	data, err = schematics.MergeGoSource(current, generated)
+	require.NoError(t, err)
+	out = string(data)
+	t.Log(out)
+	require.Contains(t, out, `fmt.Println("user init")`)
+	require.Equal(t, 1, strings.Count(out, `fmt.Println("generated init")`))
+	require.Contains(t, out, "var _ fmt.Stringer = (*T)(nil)")
+	require.Contains(t, out, "// b is added by the user.\n\tb = 2")
+	require.Equal(t, 1, strings.Count(out, "a = 1"))
+
+	// merging again doesn't duplicate anything.
+	again, err := schematics.MergeGoSource(data, generated)
+	require.NoError(t, err)
+	require.Equal(t, out, string(again))
+}
+
+func TestMergeGoSourceImports(t *testing.T) {
+
+	// the user import used by a generated declaration that has been replaced is dropped, the one still in use joins the
+	// generated import declaration.
+	current := []byte(`package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	lib "github.com/org/go-lib"
+)
+
+func main() {
+	fmt.Println(strings.ToUpper(os.Args[0]))
+}
+
+func user() {
+	_, _ = yaml.Marshal(lib.Value)
+}
+`)
+
+	generated := []byte(`package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("generated")
+}
+`)
+
+	data, err := schematics.MergeGoSource(current, generated)
+	require.NoError(t, err)
+	out := string(data)
+	t.Log(out)
+	require.Equal(t, 1, strings.Count(out, "import ("))
+	require.Contains(t, out, `"gopkg.in/yaml.v3"`)
+	require.Contains(t, out, `lib "github.com/org/go-lib"`)
+	require.NotContains(t, out, `"os"`)
+	require.NotContains(t, out, `"strings"`)
+
+	// the merged file is sound and merging again doesn't change it.
+	_, err = parser.ParseFile(token.NewFileSet(), "merged.go", data, parser.AllErrors)
+	require.NoError(t, err)
+
+	again, err := schematics.MergeGoSource(data, generated)
+	require.NoError(t, err)
+	require.Equal(t, out, string(again))
+
+	// the imports are added to a grouped declaration or to a new one.
+	for _, g := range []string{"package main\n\nimport (\n\t\"fmt\"\n)\n\nfunc main() { fmt.Println() }\n", "package main\n\nfunc main() {}\n"} {
+		data, err = schematics.MergeGoSource(current, []byte(g))
+		require.NoError(t, err)
+		require.Equal(t, 1, strings.Count(string(data), "import ("), string(data))
+		require.Contains(t, string(data), `"gopkg.in/yaml.v3"`)
+	}
+}
@@ -0,0 +1,186 @@
+package schematics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const ManifestFileName = ".tpm-schematics.lock"
+
+// ManifestFile is a file produced by a generation. Hash is the hash of the content written, Checksum the one of the content outside
+// the regions (see ComputeChecksum) and Regions the regions declared in the file. Path is relative to the target folder.
+type ManifestFile struct {
+	Path     string   `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Hash     string   `yaml:"hash,omitempty" mapstructure:"hash,omitempty" json:"hash,omitempty"`
+	Checksum string   `yaml:"checksum,omitempty" mapstructure:"checksum,omitempty" json:"checksum,omitempty"`
+	Regions  []string `yaml:"regions,omitempty" mapstructure:"regions,omitempty" json:"regions,omitempty"`
+}
+
+// Manifest records what a generation produced: it's written by Apply in the ManifestFileName file of the target folder
+// when WithApplyManifest is used.
+type Manifest struct {
+	Schematic string            `yaml:"schematic,omitempty" mapstructure:"schematic,omitempty" json:"schematic,omitempty"`
+	Version   string            `yaml:"version,omitempty" mapstructure:"version,omitempty" json:"version,omitempty"`
+	Options   map[string]string `yaml:"options,omitempty" mapstructure:"options,omitempty" json:"options,omitempty"`
+	Files     []ManifestFile    `yaml:"files,omitempty" mapstructure:"files,omitempty" json:"files,omitempty"`
+}
+
+// SchematicUpgrade reports that the target has been generated by a different version of the schematic.
+type SchematicUpgrade struct {
+	Schematic   string `yaml:"schematic,omitempty" mapstructure:"schematic,omitempty" json:"schematic,omitempty"`
+	FromVersion string `yaml:"from-version,omitempty" mapstructure:"from-version,omitempty" json:"from-version,omitempty"`
+	ToVersion   string `yaml:"to-version,omitempty" mapstructure:"to-version,omitempty" json:"to-version,omitempty"`
+}
+
+// File returns the entry of the file whose path, relative to the target folder, is fn.
+func (m *Manifest) File(fn string) (ManifestFile, bool) {
+	if m == nil {
+		return ManifestFile{}, false
+	}
+
+	for _, f := range m.Files {
+		if f.Path == fn {
+			return f, true
+		}
+	}
+
+	return ManifestFile{}, false
+}
+
+func (m *Manifest) Marshal() ([]byte, error) {
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+
+	return yaml.Marshal(m)
+}
+
+// ReadManifest reads the manifest of the target folder of the store. The bool is false if the store has no manifest.
+func ReadManifest(store ApplyStore) (Manifest, bool, error) {
+	const semLogContext = "schematics::read-manifest"
+
+	var m Manifest
+	fn := filepath.Join(store.TargetFolder(), ManifestFileName)
+	if !store.FileExists(fn) {
+		return m, false, nil
+	}
+
+	b, err := store.ReadFile(fn)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return m, false, err
+	}
+
+	if err = yaml.Unmarshal(b, &m); err != nil {
+		log.Error().Err(err).Str("file-name", fn).Msg(semLogContext)
+		return m, false, err
+	}
+
+	return m, true, nil
+}
+
+// isPreviousManifestNeeded reports if the manifest of the previous generation has to be read: it's left alone, whatever its content,
+// unless the options write a new one or rely on it to tell the generated files from the hand-written ones.
+func (cfg *ApplyOptions) isPreviousManifestNeeded() bool {
+	if cfg.manifest {
+		return true
+	}
+
+	if cfg.manualEditsPolicy != "" && cfg.manualEditsPolicy != ManualEditsPolicyIgnore {
+		return true
+	}
+
+	return cfg.deleteOtherFiles && cfg.staleFilesMode != "" && cfg.staleFilesMode != StaleFilesModeReport
+}
+
+// planManifest returns the action writing the manifest in the target folder.
+func planManifest(cfg *ApplyOptions, m *Manifest) (PlannedAction, ApplyFileResult, error) {
+	const semLogContext = "schematics::plan-manifest"
+
+	fn := filepath.Join(cfg.writer.TargetFolder(), ManifestFileName)
+	action := PlannedAction{Path: fn}
+	b, err := m.Marshal()
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return action, ApplyFileResult{}, err
+	}
+
+	action.Action, err = overwriteActionOf(cfg, fn, cfg.writer.FileExists(fn), b)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return action, ApplyFileResult{}, err
+	}
+
+	if action.Action != PlanActionUnchanged {
+		action.Writes = append(action.Writes, OpNode{Path: fn, Content: b})
+	}
+
+	return action, ApplyFileResult{Path: fn, Action: action.Action, Size: len(b)}, nil
+}
+
+// newManifestFile returns the entry of the content written in the target.
+func newManifestFile(targetFolder string, targetPath string, content []byte) ManifestFile {
+	const semLogContext = "schematics::new-manifest-file"
+
+	mf := ManifestFile{Path: relativeTargetPath(targetFolder, targetPath), Hash: contentHash(content)}
+
+	var err error
+	mf.Checksum, err = ComputeChecksum(content, WithRegionFileName(targetPath))
+	if err != nil {
+		log.Warn().Err(err).Str("path", targetPath).Msg(semLogContext)
+	}
+
+	regs, err := ReadRegionsFromBuffer(content, WithRegionFileName(targetPath))
+	if err != nil {
+		log.Warn().Err(err).Str("path", targetPath).Msg(semLogContext)
+	}
+
+	for _, r := range sortedRegions(regs) {
+		mf.Regions = append(mf.Regions, r.Name)
+	}
+
+	return mf
+}
+
+func contentHash(p []byte) string {
+	h := sha256.Sum256(p)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// manifestOptions returns the options of the generation worth recording in the manifest.
+func (cfg *ApplyOptions) manifestOptions() map[string]string {
+	opts := make(map[string]string)
+	set := func(k string, v string) {
+		if v != "" {
+			opts[k] = v
+		}
+	}
+
+	set("default-conflict-mode", cfg.defaultConflictMode)
+	set("orphan-regions-mode", cfg.orphanRegionsMode)
+	set("manual-edits-policy", cfg.manualEditsPolicy)
+	set("stale-files-mode", cfg.staleFilesMode)
+	set("structured-merge-conflict", cfg.structuredMergeConflict)
+	if cfg.flat {
+		set("flat", "true")
+	}
+
+	if cfg.regionFingerprint {
+		set("region-fingerprint", "true")
+	}
+
+	var mergeModes []string
+	for ext, m := range cfg.mergeModes {
+		mergeModes = append(mergeModes, ext+"="+m)
+	}
+	sort.Strings(mergeModes)
+	set("merge-modes", strings.Join(mergeModes, ","))
+
+	return opts
+}
@@ -0,0 +1,76 @@
+package schematics_test
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyManifest(t *testing.T) {
+
+	generated := []byte(`package main
+
+// @tpm-schematics:start-region("body")
+// @tpm-schematics:end-region("body")
+`)
+
+	src := []schematics.OpNode{
+		schematics.NewOpNode("main.go", generated),
+		schematics.NewOpNode("config.json", []byte("{\"a\": 1}\n")),
+	}
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManifest("go-service", "1.0.0"))
+	require.NoError(t, err)
+	require.Nil(t, res.Upgrade)
+	require.True(t, store.FileExists("/tmp/"+schematics.ManifestFileName))
+
+	m, ok, err := schematics.ReadManifest(store)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "go-service", m.Schematic)
+	require.Equal(t, "1.0.0", m.Version)
+	require.Equal(t, schematics.ConflictModeOverwrite, m.Options["default-conflict-mode"])
+
+	mf, ok := m.File("main.go")
+	require.True(t, ok)
+	require.Equal(t, []string{"body"}, mf.Regions)
+	require.NotEmpty(t, mf.Hash)
+
+	// a new version of the schematic drops the json file.
+	res, err = schematics.Apply(src[:1], schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManifest("go-service", "1.1.0"),
+		schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeDelete))
+	require.NoError(t, err)
+	require.Equal(t, &schematics.SchematicUpgrade{Schematic: "go-service", FromVersion: "1.0.0", ToVersion: "1.1.0"}, res.Upgrade)
+
+	// the json file is in the manifest: it gets deleted even if it doesn't carry markers.
+	require.False(t, store.FileExists("/tmp/config.json"))
+
+	m, _, err = schematics.ReadManifest(store)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 1)
+
+	// modification and manual edits detection relies on the manifest.
+	_ = store.WriteFile("/tmp/config.json", []byte("{\"a\": 1}\n"))
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManifest("go-service", "1.1.0"))
+	require.NoError(t, err)
+
+	_ = store.WriteFile("/tmp/config.json", []byte("{\"a\": 2}\n"))
+	res, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManifest("go-service", "1.1.0"),
+		schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyNew))
+	require.NoError(t, err)
+	require.False(t, res.Files[0].Modified)
+	require.True(t, res.Files[1].Modified)
+	require.Equal(t, schematics.PlanActionWriteNew, res.Files[1].Action)
+	require.Equal(t, "{\"a\": 2}\n", string(store.Files()["/tmp/config.json"]))
+
+	// a foreign lock file is read only by the options that need the manifest.
+	store = schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/"+schematics.ManifestFileName, []byte("{ not: [a manifest"))
+	_, err = schematics.Apply(src, schematics.WithStore(store))
+	require.NoError(t, err)
+
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyManifest("go-service", "1.1.0"))
+	require.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package schematics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ManualEditsPolicyIgnore = "ignore"
+	ManualEditsPolicyWarn   = "warn"
+	ManualEditsPolicyFail   = "fail"
+	ManualEditsPolicyNew    = "new"
+)
+
+var ErrManualEdits = errors.New("file edited outside regions")
+
+var checksumMarkerRegexp = regexp.MustCompile(`@tpm-schematics:checksum\("([a-f0-9]+)"\)`)
+
+// ComputeChecksum returns the checksum of the content of p outside the regions: the region markers, the content of the regions and
+// the embedded checksum line are not part of it. The line ending style, the final newline and the BOM are not relevant either.
+func ComputeChecksum(p []byte, opts ...RegionOption) (string, error) {
+	const semLogContext = "schematics::compute-checksum"
+
+	cfg := newRegionOptions(opts...)
+	scanner := bufio.NewReader(bytes.NewReader(normalizeText(p)))
+
+	var sb strings.Builder
+	depth := 0
+	var lineno int
+	l, err := util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
+	for err == nil {
+		lineno++
+		marker, ok := getRegionDemarcation(cfg.syntaxes, l)
+		switch {
+		case ok && marker.demarcation == RegionDemarcationStart:
+			depth++
+		case ok:
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && !checksumMarkerRegexp.MatchString(l):
+			sb.WriteString(l)
+			sb.WriteString("\n")
+		}
+
+		l, err = util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
+	}
+
+	if err != io.EOF {
+		log.Error().Err(err).Int("line", lineno).Msg(semLogContext)
+		return "", err
+	}
+
+	return regionFingerprint(sb.String()), nil
+}
+
+// ReadEmbeddedChecksum returns the checksum embedded in p by StampChecksum. The bool is false if p doesn't carry one.
+func ReadEmbeddedChecksum(p []byte) (string, bool) {
+	if m := checksumMarkerRegexp.FindSubmatch(p); m != nil {
+		return string(m[1]), true
+	}
+
+	return "", false
+}
+
+// StampChecksum embeds in p, as a comment on the last line, the checksum of its content outside the regions. The previous checksum
+// line, if any, is replaced. The bool is false if the file type fn doesn't support comments: p is returned as is.
+func StampChecksum(fn string, p []byte) ([]byte, bool, error) {
+	const semLogContext = "schematics::stamp-checksum"
+
+	var commentSyntax *RegionSyntax
+	for _, rs := range RegionSyntaxesForFile(fn) {
+		if rs.CommentStart != "" {
+			commentSyntax = &rs
+			break
+		}
+	}
+
+	if commentSyntax == nil {
+		log.Trace().Str("file-name", fn).Msg(semLogContext + " - file type doesn't support comments")
+		return p, false, nil
+	}
+
+	checksum, err := ComputeChecksum(p, WithRegionFileName(fn))
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, false, err
+	}
+
+	tf := DetectTextFormat(p)
+	var sb strings.Builder
+	for _, l := range strings.SplitAfter(string(normalizeText(p)), "\n") {
+		if l != "" && !checksumMarkerRegexp.MatchString(l) {
+			sb.WriteString(l)
+		}
+	}
+
+	if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+		sb.WriteString("\n")
+	}
+
+	l, _ := commentSyntax.CommentLine(fmt.Sprintf("@tpm-schematics:checksum(%q)", checksum))
+	sb.WriteString(l)
+	sb.WriteString("\n")
+	return tf.Format([]byte(sb.String())), true, nil
+}
+
+// IsEditedOutsideRegions reports if the content of p outside the regions differs from the checksum embedded in it.
+// Files without an embedded checksum are not reported.
+func IsEditedOutsideRegions(fn string, p []byte) (bool, error) {
+	checksum, ok := ReadEmbeddedChecksum(p)
+	if !ok {
+		return false, nil
+	}
+
+	actual, err := ComputeChecksum(p, WithRegionFileName(fn))
+	if err != nil {
+		return false, err
+	}
+
+	return actual != checksum, nil
+}
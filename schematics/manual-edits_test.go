@@ -0,0 +1,62 @@
+package schematics_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualEdits(t *testing.T) {
+
+	generated := []byte(`package main
+
+func main() {
+	// @tpm-schematics:start-region("body")
+	// @tpm-schematics:end-region("body")
+}
+`)
+
+	src := []schematics.OpNode{schematics.NewOpNode("main.go", generated)}
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyFail))
+	require.NoError(t, err)
+
+	stamped := store.Files()["/tmp/main.go"]
+	_, ok := schematics.ReadEmbeddedChecksum(stamped)
+	require.True(t, ok)
+
+	// edits inside the regions are fine.
+	edited := strings.Replace(string(stamped), "\t// @tpm-schematics:end-region(\"body\")", "\tprintln(\"hello\")\n\t// @tpm-schematics:end-region(\"body\")", 1)
+	isEdited, err := schematics.IsEditedOutsideRegions("main.go", []byte(edited))
+	require.NoError(t, err)
+	require.False(t, isEdited)
+
+	_ = store.WriteFile("/tmp/main.go", []byte(edited))
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyFail))
+	require.NoError(t, err)
+	require.Empty(t, res.ManualEdits)
+	require.Contains(t, string(store.Files()["/tmp/main.go"]), "println(\"hello\")")
+
+	// edits outside.
+	edited = strings.Replace(edited, "func main() {", "func main() {\n\tdefer cleanup()", 1)
+	_ = store.WriteFile("/tmp/main.go", []byte(edited))
+
+	res, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyFail))
+	require.True(t, errors.Is(err, schematics.ErrManualEdits))
+	require.Len(t, res.ManualEdits, 1)
+
+	res, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyNew))
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/main.go", res.ManualEdits[0].Path)
+	require.Equal(t, edited, string(store.Files()["/tmp/main.go"]))
+	require.Contains(t, string(store.Files()["/tmp/main.go.new"]), "println(\"hello\")")
+
+	res, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyManualEditsPolicy(schematics.ManualEditsPolicyWarn))
+	require.NoError(t, err)
+	require.Len(t, res.ManualEdits, 1)
+	require.NotContains(t, string(store.Files()["/tmp/main.go"]), "cleanup()")
+}
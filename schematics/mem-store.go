@@ -60,13 +60,32 @@ func (fw *ApplyMemoryStore) ListFilenames(rexp *regexp.Regexp) (map[string]struc
 	return files, nil
 }
 
-func (fw *ApplyMemoryStore) RecoverRegionsOfFile(fromFile string, toContent []byte) ([]byte, error) {
+func (fw *ApplyMemoryStore) RecoverRegionsOfFile(fromFile string, toContent []byte, opts ...RegionOption) ([]byte, error) {
 	if !fw.FileExists(fromFile) {
 		return toContent, nil
 	}
 
 	b, _ := fw.m[fromFile]
-	return RecoverRegions(b, toContent)
+	return RecoverRegions(b, toContent, append([]RegionOption{WithRegionFileName(fromFile)}, opts...)...)
+}
+
+func (fw *ApplyMemoryStore) RemoveFile(fn string) error {
+	if !fw.FileExists(fn) {
+		return errors.New("file not found in memory writer: " + fn)
+	}
+
+	delete(fw.m, fn)
+	return nil
+}
+
+func (fw *ApplyMemoryStore) RenameFile(fromFile string, toFile string) error {
+	if !fw.FileExists(fromFile) {
+		return errors.New("file not found in memory writer: " + fromFile)
+	}
+
+	fw.m[toFile] = fw.m[fromFile]
+	delete(fw.m, fromFile)
+	return nil
 }
 
 func (fw *ApplyMemoryStore) ReadFile(fn string) ([]byte, error) {
@@ -78,3 +97,27 @@ func (fw *ApplyMemoryStore) ReadFile(fn string) ([]byte, error) {
 
 	return b, nil
 }
+
+// BeginTransaction returns a transaction working on a copy of the files: the copy replaces the files of the store on Commit.
+func (fw *ApplyMemoryStore) BeginTransaction() (ApplyTransaction, error) {
+	staging := &ApplyMemoryStore{targetFolder: fw.targetFolder, m: make(map[string][]byte, len(fw.m))}
+	for k, v := range fw.m {
+		staging.m[k] = v
+	}
+
+	return &applyMemoryTransaction{ApplyMemoryStore: staging, store: fw}, nil
+}
+
+type applyMemoryTransaction struct {
+	*ApplyMemoryStore
+	store *ApplyMemoryStore
+}
+
+func (tx *applyMemoryTransaction) Commit() error {
+	tx.store.m = tx.m
+	return nil
+}
+
+func (tx *applyMemoryTransaction) Rollback() error {
+	return nil
+}
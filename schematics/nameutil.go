@@ -2,9 +2,11 @@ package schematics
 
 import (
 	"fmt"
-	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util"
+	"reflect"
 	"regexp"
 	"strings"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util"
 )
 
 const (
@@ -13,37 +15,225 @@ const (
 	NameFormattingDecamelize = "@decamelize"
 	NameFormattingClassify   = "@classify"
 	NameFormattingUnderscore = "@underscore"
+	NameFormattingPathify    = "@pathify"
+)
+
+const (
+	NameEscapeDotPrefix        = "dot-"
+	NameEscapeUnderscorePrefix = "underscore-"
+)
+
+// nameBuiltinProperties are the properties always available to the placeholders (unless overridden by the metadata).
+// e(__dot__) and e(__underscore__) are the placeholder form of the dot- and underscore- escaping prefixes.
+var nameBuiltinProperties = map[string]interface{}{
+	"dot":        ".",
+	"underscore": "_",
+}
+
+var (
+	namePropertiesModel    = []string{"Model", "model"}
+	namePropertiesMetadata = []string{"Metadata", "metadata"}
 )
 
-var schematicsNameRegexp = regexp.MustCompile(`e\(__([a-zA-Z0-9\-]+)(@dasherize|@classify|@camelize|@decamelize|@underscore)?__\)`)
+var schematicsNameRegexp = regexp.MustCompile(`e\(__([a-zA-Z0-9\-]+(?:\.[a-zA-Z0-9\-]+)*)(@dasherize|@classify|@camelize|@decamelize|@underscore|@pathify)?__\)`)
 
+// ResolveSchematicsName replaces the e(__prop@modifier__) placeholders found in fn with the values of props.
+// The property can be a dotted path (i.e. e(__model.entity.name@dasherize__)) that walks nested maps and struct fields.
 func ResolveSchematicsName(fn string, props map[string]interface{}) (string, error) {
 	matches := schematicsNameRegexp.FindAllSubmatch([]byte(fn), -1)
 	for _, m := range matches {
-		p := string(m[1])
-		mod := string(m[2])
+		pv, err := resolveSchematicsPlaceholder(string(m[1]), string(m[2]), props)
+		if err != nil {
+			return fn, fmt.Errorf("%w referenced in name %s", err, fn)
+		}
+
+		fn = strings.ReplaceAll(fn, string(m[0]), pv)
+	}
+
+	return fn, nil
+}
+
+// ResolveSchematicsPath resolves the placeholders of each segment of the slash separated path fn.
+// If all the placeholders of a segment resolve to an empty string the segment is considered empty and the path has to be
+// skipped: the returned bool is false. Since the check is done on every segment, an empty folder name drops the whole subtree.
+func ResolveSchematicsPath(fn string, props map[string]interface{}) (string, bool, error) {
+	segments := strings.Split(fn, "/")
+	for i, seg := range segments {
+		matches := schematicsNameRegexp.FindAllStringSubmatch(seg, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		isEmpty := true
+		for _, m := range matches {
+			pv, err := resolveSchematicsPlaceholder(m[1], m[2], props)
+			if err != nil {
+				return fn, false, fmt.Errorf("%w referenced in name %s", err, fn)
+			}
+
+			if pv != "" {
+				isEmpty = false
+			}
+			seg = strings.ReplaceAll(seg, m[0], pv)
+		}
+
+		if isEmpty {
+			return "", false, nil
+		}
+
+		segments[i] = seg
+	}
+
+	return strings.Join(segments, "/"), true, nil
+}
+
+// UnescapeSchematicsName turns the segments escaped with the dot- or underscore- prefix (i.e. dot-gitignore) into hidden names
+// (i.e. .gitignore): embed.FS drops files starting with '.' or '_' unless the all: prefix is used. The escaping is applied to the
+// templates only when asked with SourceWithNameEscaping since it would rename existing segments like dot-product.go.
+func UnescapeSchematicsName(fn string) string {
+	segments := strings.Split(fn, "/")
+	for i, seg := range segments {
+		segments[i] = unescapeSchematicsSegment(seg)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func unescapeSchematicsSegment(seg string) string {
+	switch {
+	case strings.HasPrefix(seg, NameEscapeDotPrefix) && len(seg) > len(NameEscapeDotPrefix):
+		return "." + strings.TrimPrefix(seg, NameEscapeDotPrefix)
+	case strings.HasPrefix(seg, NameEscapeUnderscorePrefix) && len(seg) > len(NameEscapeUnderscorePrefix):
+		return "_" + strings.TrimPrefix(seg, NameEscapeUnderscorePrefix)
+	}
+
+	return seg
+}
+
+// isHiddenOrEscapedSegment reports if the segment is a name that embed.FS would drop without the all: prefix or its placeholder form.
+func isHiddenOrEscapedSegment(seg string) bool {
+	return strings.HasPrefix(seg, ".") || strings.HasPrefix(seg, "_") ||
+		strings.Contains(seg, "e(__dot__)") || strings.Contains(seg, "e(__underscore__)")
+}
 
-		ipv, ok := props[p]
+func resolveSchematicsPlaceholder(p string, mod string, props map[string]interface{}) (string, error) {
+	ipv, err := lookupNameProperty(props, p)
+	if err != nil {
+		return "", err
+	}
+
+	if ipv == nil {
+		return "", nil
+	}
+
+	pv := fmt.Sprint(ipv)
+	if pv == "" {
+		return pv, nil
+	}
+
+	switch mod {
+	case NameFormattingDasherize:
+		pv = util.Dasherize(pv)
+	case NameFormattingCamelize:
+		pv = util.Camelize(pv)
+	case NameFormattingDecamelize:
+		pv = util.Decamelize(pv)
+	case NameFormattingClassify:
+		pv = util.Classify(pv)
+	case NameFormattingUnderscore:
+		pv = util.Underscore(pv)
+	case NameFormattingPathify:
+		pv = strings.ReplaceAll(pv, ".", "/")
+	}
+
+	return pv, nil
+}
+
+// nameProperties returns the properties available to the file name placeholders: the metadata top level keys plus the
+// Model and the Metadata themselves under the Model/model and Metadata/metadata keys (unless already defined).
+func (ctx *SourceContext) nameProperties() map[string]interface{} {
+	props := make(map[string]interface{}, len(ctx.Metadata)+2)
+	for k, v := range ctx.Metadata {
+		props[k] = v
+	}
+
+	for _, n := range namePropertiesModel {
+		if _, ok := props[n]; !ok && ctx.Model != nil {
+			props[n] = ctx.Model
+		}
+	}
+
+	for _, n := range namePropertiesMetadata {
+		if _, ok := props[n]; !ok && ctx.Metadata != nil {
+			props[n] = ctx.Metadata
+		}
+	}
+
+	return props
+}
+
+func lookupNameProperty(props map[string]interface{}, propPath string) (interface{}, error) {
+	segments := strings.Split(propPath, ".")
+
+	var current interface{} = props
+	for i, s := range segments {
+		v, ok := lookupNamePropertySegment(current, s)
 		if !ok {
-			return fn, fmt.Errorf("cannot find property %s referenced in name %s", p, fn)
+			if i == 0 {
+				if bv, ok := nameBuiltinProperties[propPath]; ok {
+					return bv, nil
+				}
+				return nil, fmt.Errorf("cannot find property %s", propPath)
+			}
+			return nil, fmt.Errorf("cannot find property %s: missing segment %s in %s", propPath, s, strings.Join(segments[:i], "."))
+		}
+		current = v
+	}
+
+	return current, nil
+}
+
+func lookupNamePropertySegment(obj interface{}, segment string) (interface{}, bool) {
+	if obj == nil {
+		return nil, false
+	}
+
+	if m, ok := obj.(map[string]interface{}); ok {
+		v, ok := m[segment]
+		return v, ok
+	}
+
+	rv := reflect.ValueOf(obj)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, false
 		}
+		rv = rv.Elem()
+	}
 
-		pv := fmt.Sprint(ipv)
-		switch mod {
-		case NameFormattingDasherize:
-			pv = util.Dasherize(pv)
-		case NameFormattingCamelize:
-			pv = util.Camelize(pv)
-		case NameFormattingDecamelize:
-			pv = util.Decamelize(pv)
-		case NameFormattingClassify:
-			pv = util.Classify(pv)
-		case NameFormattingUnderscore:
-			pv = util.Underscore(pv)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
 		}
 
-		fn = strings.ReplaceAll(fn, string(m[0]), pv)
+		v := rv.MapIndex(reflect.ValueOf(segment).Convert(rv.Type().Key()))
+		if !v.IsValid() {
+			return nil, false
+		}
+		return v.Interface(), true
+	case reflect.Struct:
+		f := rv.FieldByName(segment)
+		if !f.IsValid() {
+			// give a chance to the lower-case form usually found in templates (i.e. name vs Name)
+			f = rv.FieldByName(util.Classify(segment))
+		}
+
+		if !f.IsValid() || !f.CanInterface() {
+			return nil, false
+		}
+		return f.Interface(), true
 	}
 
-	return fn, nil
+	return nil, false
 }
@@ -40,3 +40,108 @@ func TestResolveSchematicsName(t *testing.T) {
 	}
 
 }
+
+type nameTestEntity struct {
+	Name string
+}
+
+type nameTestModel struct {
+	Entity  nameTestEntity
+	Service map[string]interface{}
+}
+
+func TestResolveSchematicsNameNestedProperties(t *testing.T) {
+
+	props := map[string]interface{}{
+		"name": "pippo",
+		"service": map[string]interface{}{
+			"package": "com.example.svc",
+		},
+		"model": &nameTestModel{
+			Entity:  nameTestEntity{Name: "customerOrder"},
+			Service: map[string]interface{}{"name": "orders"},
+		},
+	}
+
+	s := []InputWanted{
+		{input: "e(__service.package@pathify__)/main.go", wanted: "com/example/svc/main.go"},
+		{input: "e(__model.entity.name@dasherize__).java", wanted: "customer-order.java"},
+		{input: "e(__model.Entity.Name@classify__).java", wanted: "CustomerOrder.java"},
+		{input: "e(__model.Service.name__)/e(__name__).txt", wanted: "orders/pippo.txt"},
+	}
+
+	for _, iw := range s {
+		n1, err := schematics.ResolveSchematicsName(iw.input, props)
+		require.NoError(t, err)
+		require.Equal(t, iw.wanted, n1)
+	}
+
+	_, err := schematics.ResolveSchematicsName("e(__model.entity.missing__).java", props)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "model.entity.missing")
+	t.Log(err)
+}
+
+func TestResolveSchematicsPath(t *testing.T) {
+
+	props := map[string]interface{}{
+		"name":     "pippo",
+		"empty":    "",
+		"optional": map[string]interface{}{"folder": ""},
+	}
+
+	s := []struct {
+		input  string
+		wanted string
+		ok     bool
+	}{
+		{input: "/e(__name@dasherize__)/nested-file.txt", wanted: "/pippo/nested-file.txt", ok: true},
+		{input: "/e(__empty@dasherize__)/nested-file.txt", ok: false},
+		{input: "e(__empty__).java", ok: false},
+		{input: "e(__optional.folder__)/sub/file.txt", ok: false},
+		{input: "e(__empty__)e(__name__).java", wanted: "pippo.java", ok: true},
+	}
+
+	for _, iw := range s {
+		n1, ok, err := schematics.ResolveSchematicsPath(iw.input, props)
+		require.NoError(t, err)
+		require.Equal(t, iw.ok, ok, iw.input)
+		require.Equal(t, iw.wanted, n1, iw.input)
+	}
+}
+
+func TestResolveSchematicsNameHiddenFiles(t *testing.T) {
+
+	props := map[string]interface{}{
+		"name": "pippo",
+	}
+
+	s := []InputWanted{
+		{input: "dot-product.go", wanted: "dot-product.go"},
+		{input: "e(__dot__)dockerignore", wanted: ".dockerignore"},
+		{input: "e(__underscore__)e(__name__).scss", wanted: "_pippo.scss"},
+	}
+
+	for _, iw := range s {
+		n1, err := schematics.ResolveSchematicsName(iw.input, props)
+		require.NoError(t, err)
+		require.Equal(t, iw.wanted, n1)
+
+		n1, ok, err := schematics.ResolveSchematicsPath(iw.input, props)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, iw.wanted, n1)
+	}
+
+	// the prefixes are unescaped only when asked (see SourceWithNameEscaping).
+	s = []InputWanted{
+		{input: "dot-gitignore", wanted: ".gitignore"},
+		{input: "/dot-github/workflows/build.yml", wanted: "/.github/workflows/build.yml"},
+		{input: "underscore-layout.html", wanted: "_layout.html"},
+		{input: "dot-", wanted: "dot-"},
+	}
+
+	for _, iw := range s {
+		require.Equal(t, iw.wanted, schematics.UnescapeSchematicsName(iw.input))
+	}
+}
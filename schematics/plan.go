@@ -0,0 +1,155 @@
+package schematics
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PlanActionCreate          = "create"
+	PlanActionOverwrite       = "overwrite"
+	PlanActionUnchanged       = "unchanged"
+	PlanActionKeep            = "keep"
+	PlanActionBackupOverwrite = "backup+overwrite"
+	PlanActionWriteNew        = "write-new"
+	PlanActionMerge           = "merge"
+	PlanActionStale           = "stale"
+	PlanActionDelete          = "delete"
+	PlanActionRename          = "rename"
+	PlanActionQuarantine      = "quarantine"
+)
+
+// PlannedAction is what Apply is going to do with a target file. Writes are the files to be written by the action: the target
+// itself and the companion files (.bak, .patch, .new, .orphans). MoveTo is the destination of a stale file being renamed or
+// quarantined.
+type PlannedAction struct {
+	Path         string   `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Action       string   `yaml:"action,omitempty" mapstructure:"action,omitempty" json:"action,omitempty"`
+	ConflictMode string   `yaml:"conflict-mode,omitempty" mapstructure:"conflict-mode,omitempty" json:"conflict-mode,omitempty"`
+	MoveTo       string   `yaml:"move-to,omitempty" mapstructure:"move-to,omitempty" json:"move-to,omitempty"`
+	Writes       []OpNode `yaml:"-" mapstructure:"-" json:"-"`
+}
+
+// WritePaths returns the paths of the files written by the action.
+func (pa PlannedAction) WritePaths() []string {
+	var paths []string
+	for _, w := range pa.Writes {
+		paths = append(paths, w.Path)
+	}
+
+	return paths
+}
+
+type ApplyPlan struct {
+	Actions []PlannedAction `yaml:"actions,omitempty" mapstructure:"actions,omitempty" json:"actions,omitempty"`
+	Result  ApplyResult     `yaml:"result,omitempty" mapstructure:"result,omitempty" json:"result,omitempty"`
+}
+
+// ExecutePlan writes to the store the files of the plan returned by Plan. The store is the one set in the options. If the store is a
+// TransactionalApplyStore the changes are staged and committed together: on failure the target is left as it was.
+func ExecutePlan(plan ApplyPlan, opts ...ApplyOption) (ApplyResult, error) {
+	const semLogContext = "schematics::execute-plan"
+
+	cfg := ApplyOptions{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	var tx ApplyTransaction
+	var w applyStoreWriter = cfg.writer
+	if ts, ok := cfg.writer.(TransactionalApplyStore); ok {
+		var err error
+		tx, err = ts.BeginTransaction()
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return plan.Result, err
+		}
+
+		w = tx
+	}
+
+	if err := executePlanActions(w, plan.Actions); err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		if tx != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Error().Err(rbErr).Msg(semLogContext + " - rollback failed")
+				err = errors.Join(err, rbErr)
+			}
+		}
+
+		return plan.Result, err
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return plan.Result, err
+		}
+	}
+
+	return plan.Result, nil
+}
+
+// applyStoreWriter is what ExecutePlan needs to change the target: either the store or a transaction of the store.
+type applyStoreWriter interface {
+	WriteFile(fn string, p []byte) error
+	RemoveFile(fn string) error
+	RenameFile(fromFile string, toFile string) error
+}
+
+func executePlanActions(w applyStoreWriter, actions []PlannedAction) error {
+	const semLogContext = "schematics::execute-plan-actions"
+
+	for _, a := range actions {
+		switch a.Action {
+		case PlanActionDelete:
+			log.Info().Str("file-name", a.Path).Msg(semLogContext + " deleting file not in current generation")
+			if err := w.RemoveFile(a.Path); err != nil {
+				log.Error().Err(err).Str("file-name", a.Path).Msg(semLogContext)
+				return err
+			}
+			continue
+		case PlanActionRename, PlanActionQuarantine:
+			log.Info().Str("file-name", a.Path).Str("move-to", a.MoveTo).Msg(semLogContext + " moving file not in current generation")
+			if err := w.RenameFile(a.Path, a.MoveTo); err != nil {
+				log.Error().Err(err).Str("file-name", a.Path).Msg(semLogContext)
+				return err
+			}
+			continue
+		}
+
+		for _, wn := range a.Writes {
+			log.Info().Str("file-name", wn.Path).Str("action", a.Action).Msg(semLogContext)
+			err := w.WriteFile(wn.Path, wn.Content)
+			if err != nil {
+				log.Error().Err(err).Msg(semLogContext)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// overwriteActionOf tells apart the creation of a file, its update and the regeneration of the same content.
+func overwriteActionOf(cfg *ApplyOptions, targetPath string, exists bool, content []byte) (string, error) {
+	const semLogContext = "schematics::overwrite-action-of"
+
+	if !exists {
+		return PlanActionCreate, nil
+	}
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return "", err
+	}
+
+	if bytes.Equal(current, content) {
+		return PlanActionUnchanged, nil
+	}
+
+	return PlanActionOverwrite, nil
+}
@@ -0,0 +1,68 @@
+package schematics_test
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/same.txt", []byte("same\n"))
+	_ = store.WriteFile("/tmp/changed.txt", []byte("old\n"))
+	_ = store.WriteFile("/tmp/stale.txt", []byte("stale\n"))
+
+	src := []schematics.OpNode{
+		schematics.NewOpNode("created.txt", []byte("created\n")),
+		schematics.NewOpNode("same.txt", []byte("same\n")),
+		schematics.NewOpNode("changed.txt", []byte("new\n")),
+	}
+
+	opts := []schematics.ApplyOption{
+		schematics.WithStore(store),
+		schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite),
+		schematics.WithDeleteOtherFiles(""),
+	}
+
+	plan, err := schematics.Plan(src, opts...)
+	require.NoError(t, err)
+
+	actions := make(map[string]string)
+	for _, a := range plan.Actions {
+		actions[a.Path] = a.Action
+	}
+
+	require.Equal(t, map[string]string{
+		"/tmp/created.txt": schematics.PlanActionCreate,
+		"/tmp/same.txt":    schematics.PlanActionUnchanged,
+		"/tmp/changed.txt": schematics.PlanActionOverwrite,
+		"/tmp/stale.txt":   schematics.PlanActionStale,
+	}, actions)
+
+	// nothing has been written.
+	require.False(t, store.FileExists("/tmp/created.txt"))
+	require.Equal(t, "old\n", string(store.Files()["/tmp/changed.txt"]))
+
+	_, err = schematics.ExecutePlan(plan, opts...)
+	require.NoError(t, err)
+	require.Equal(t, "created\n", string(store.Files()["/tmp/created.txt"]))
+	require.Equal(t, "new\n", string(store.Files()["/tmp/changed.txt"]))
+
+	_ = store.WriteFile("/tmp/changed.txt", []byte("old\n"))
+	plan, err = schematics.Plan(src[2:3], schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeBackup))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionBackupOverwrite, plan.Actions[0].Action)
+	require.Equal(t, []string{"/tmp/changed.txt", "/tmp/changed.txt.bak"}, plan.Actions[0].WritePaths())
+
+	plan, err = schematics.Plan(src[2:3], schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeNew))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionWriteNew, plan.Actions[0].Action)
+	require.Equal(t, []string{"/tmp/changed.txt.new"}, plan.Actions[0].WritePaths())
+
+	plan, err = schematics.Plan(src[2:3], schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeKeep))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionKeep, plan.Actions[0].Action)
+	require.Empty(t, plan.Actions[0].Writes)
+}
@@ -0,0 +1,74 @@
+package schematics
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	indentSensitiveRegistryMu sync.RWMutex
+	indentSensitiveRegistry   = map[string]struct{}{
+		".yaml": {},
+		".yml":  {},
+		".py":   {},
+		".pyw":  {},
+		".haml": {},
+		".pug":  {},
+		".slim": {},
+		".sass": {},
+		".styl": {},
+	}
+)
+
+// RegisterIndentSensitiveFile marks the files with the given extension (i.e. '.yaml') or base name as indentation sensitive:
+// the regions recovered in those files are re-indented by default.
+func RegisterIndentSensitiveFile(ext string) {
+	indentSensitiveRegistryMu.Lock()
+	defer indentSensitiveRegistryMu.Unlock()
+
+	indentSensitiveRegistry[ext] = struct{}{}
+}
+
+// IsIndentSensitiveFile reports if the base name or the extension of fn has been registered as indentation sensitive.
+func IsIndentSensitiveFile(fn string) bool {
+	indentSensitiveRegistryMu.RLock()
+	defer indentSensitiveRegistryMu.RUnlock()
+
+	if _, ok := indentSensitiveRegistry[filepath.Base(fn)]; ok {
+		return true
+	}
+
+	_, ok := indentSensitiveRegistry[strings.ToLower(filepath.Ext(fn))]
+	return ok
+}
+
+// lineIndentation returns the leading blanks of l.
+func lineIndentation(l string) string {
+	return l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+}
+
+// reindentRegionContent shifts the lines of content from the indentation of the old start marker to the one of the new marker.
+// When the new indentation extends the old one the difference is added to every non blank line. Otherwise (deeper markers moved
+// up, tabs replaced by spaces) the old indentation is replaced by the new one in the lines that start with it.
+func reindentRegionContent(content string, oldIndent string, newIndent string) string {
+	if oldIndent == newIndent || content == "" {
+		return content
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(newIndent, oldIndent):
+			lines[i] = newIndent[len(oldIndent):] + l
+		case strings.HasPrefix(l, oldIndent):
+			lines[i] = newIndent + l[len(oldIndent):]
+		}
+	}
+
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,331 @@
+package schematics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RegionInventoryFormatJSON = "json"
+	RegionInventoryFormatYAML = "yaml"
+)
+
+// RegionInventoryEntry is a region of a file of the target. Customized reports if the content differs from the template default:
+// the default is known (HasDefault) if the template output has been provided or the region carries a fingerprint.
+type RegionInventoryEntry struct {
+	Name       string `yaml:"name,omitempty" mapstructure:"name,omitempty" json:"name,omitempty"`
+	Parent     string `yaml:"parent,omitempty" mapstructure:"parent,omitempty" json:"parent,omitempty"`
+	Size       int    `yaml:"size,omitempty" mapstructure:"size,omitempty" json:"size,omitempty"`
+	HasDefault bool   `yaml:"has-default,omitempty" mapstructure:"has-default,omitempty" json:"has-default,omitempty"`
+	Customized bool   `yaml:"customized,omitempty" mapstructure:"customized,omitempty" json:"customized,omitempty"`
+	Content    string `yaml:"content,omitempty" mapstructure:"content,omitempty" json:"content,omitempty"`
+}
+
+// RegionInventoryFile lists the regions of a file. Path is relative to the target folder of the store.
+type RegionInventoryFile struct {
+	Path    string                 `yaml:"path,omitempty" mapstructure:"path,omitempty" json:"path,omitempty"`
+	Error   string                 `yaml:"error,omitempty" mapstructure:"error,omitempty" json:"error,omitempty"`
+	Regions []RegionInventoryEntry `yaml:"regions,omitempty" mapstructure:"regions,omitempty" json:"regions,omitempty"`
+}
+
+type RegionInventory struct {
+	Files []RegionInventoryFile `yaml:"files,omitempty" mapstructure:"files,omitempty" json:"files,omitempty"`
+}
+
+type RegionInventoryOptions struct {
+	filesPattern *regexp.Regexp
+	defaults     []OpNode
+}
+
+type RegionInventoryOption func(*RegionInventoryOptions)
+
+// WithRegionInventoryFilesPattern restricts the inventory to the files matched by the expression.
+func WithRegionInventoryFilesPattern(pattern string) RegionInventoryOption {
+	return func(opts *RegionInventoryOptions) {
+		if pattern != "" {
+			opts.filesPattern = regexp.MustCompile(pattern)
+		}
+	}
+}
+
+// WithRegionInventoryDefaults provides the template output (i.e. from GetSource) the regions are compared with.
+func WithRegionInventoryDefaults(nodes []OpNode) RegionInventoryOption {
+	return func(opts *RegionInventoryOptions) {
+		opts.defaults = nodes
+	}
+}
+
+// ReadRegionInventory walks the files of the store and lists their regions.
+func ReadRegionInventory(store ApplyStore, opts ...RegionInventoryOption) (RegionInventory, error) {
+	const semLogContext = "schematics::read-region-inventory"
+
+	cfg := RegionInventoryOptions{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	var inv RegionInventory
+	files, err := store.ListFilenames(cfg.filesPattern)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return inv, err
+	}
+
+	targetFolder := store.TargetFolder()
+	defaults := make(map[string][]byte)
+	for _, n := range cfg.defaults {
+		defaults[filepath.Join(targetFolder, n.Path)] = n.Content
+	}
+
+	var paths []string
+	for fn := range files {
+		paths = append(paths, fn)
+	}
+	sort.Strings(paths)
+
+	for _, fn := range paths {
+		b, err := store.ReadFile(fn)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return inv, err
+		}
+
+		invFile := RegionInventoryFile{Path: relativeTargetPath(targetFolder, fn)}
+		regs, err := ReadRegionsFromBuffer(b, WithRegionFileName(fn))
+		if err != nil {
+			// a file that cannot be parsed doesn't prevent the inventory of the others.
+			log.Warn().Err(err).Str("file-name", fn).Msg(semLogContext)
+			invFile.Error = err.Error()
+			inv.Files = append(inv.Files, invFile)
+			continue
+		}
+
+		if len(regs) == 0 {
+			continue
+		}
+
+		var defaultRegs map[string]RegionInfo
+		if d, ok := defaults[fn]; ok {
+			defaultRegs, _ = ReadRegionsFromBuffer(d, WithRegionFileName(fn))
+		}
+
+		for _, r := range sortedRegions(regs) {
+			e := RegionInventoryEntry{Name: r.Name, Parent: r.Parent, Size: r.Size, Content: r.Content}
+			if dr, ok := defaultRegs[r.Name]; ok {
+				e.HasDefault = true
+				e.Customized = dr.Content != r.Content
+			} else if _, ok := r.Attributes[RegionAttributeFingerprint]; ok {
+				e.HasDefault = true
+				e.Customized = !r.IsUntouched()
+			}
+			invFile.Regions = append(invFile.Regions, e)
+		}
+
+		inv.Files = append(inv.Files, invFile)
+	}
+
+	return inv, nil
+}
+
+// Marshal serializes the inventory in the RegionInventoryFormatJSON or RegionInventoryFormatYAML format.
+func (inv RegionInventory) Marshal(format string) ([]byte, error) {
+	if format == RegionInventoryFormatYAML {
+		return yaml.Marshal(inv)
+	}
+
+	return json.MarshalIndent(inv, "", "  ")
+}
+
+func UnmarshalRegionInventory(b []byte, format string) (RegionInventory, error) {
+	var inv RegionInventory
+	var err error
+	if format == RegionInventoryFormatYAML {
+		err = yaml.Unmarshal(b, &inv)
+	} else {
+		err = json.Unmarshal(b, &inv)
+	}
+
+	return inv, err
+}
+
+// SaveRegionInventory writes the inventory to fn. The format is picked from the extension of the file (.yaml, .yml or json).
+func SaveRegionInventory(fn string, inv RegionInventory) error {
+	b, err := inv.Marshal(regionInventoryFormat(fn))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fn, b, fs.ModePerm)
+}
+
+func LoadRegionInventory(fn string) (RegionInventory, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return RegionInventory{}, err
+	}
+
+	return UnmarshalRegionInventory(b, regionInventoryFormat(fn))
+}
+
+// ImportRegionInventory writes the content of the regions of the inventory in the files of the store. The files are resolved
+// relative to the target folder of the store: the missing files and the regions not declared in the files are skipped.
+// The returned inventory lists what has been imported.
+func ImportRegionInventory(store ApplyStore, inv RegionInventory) (RegionInventory, error) {
+	const semLogContext = "schematics::import-region-inventory"
+
+	var imported RegionInventory
+	for _, f := range inv.Files {
+		fn := filepath.Join(store.TargetFolder(), f.Path)
+		if !store.FileExists(fn) {
+			log.Warn().Str("file-name", fn).Msg(semLogContext + " - file not found, skipping")
+			continue
+		}
+
+		b, err := store.ReadFile(fn)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return imported, err
+		}
+
+		regs := make(map[string]string)
+		for _, r := range f.Regions {
+			regs[r.Name] = r.Content
+		}
+
+		b, replaced, err := ReplaceRegions(b, regs, WithRegionFileName(fn))
+		if err != nil {
+			log.Error().Err(err).Str("file-name", fn).Msg(semLogContext)
+			return imported, err
+		}
+
+		if len(replaced) == 0 {
+			continue
+		}
+
+		if err = store.WriteFile(fn, b); err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return imported, err
+		}
+
+		importedFile := RegionInventoryFile{Path: f.Path}
+		for _, r := range f.Regions {
+			if _, ok := replaced[r.Name]; ok {
+				importedFile.Regions = append(importedFile.Regions, r)
+			}
+		}
+		imported.Files = append(imported.Files, importedFile)
+	}
+
+	return imported, nil
+}
+
+// ReplaceRegions sets the content of the regions of p found in regs. When both a region and one of its nested regions are in regs
+// the content of the outer one wins. The names of the regions replaced are returned.
+func ReplaceRegions(p []byte, regs map[string]string, opts ...RegionOption) ([]byte, map[string]struct{}, error) {
+	const semLogContext = "schematics::replace-regions"
+
+	cfg := newRegionOptions(opts...)
+	tf := cfg.outputTextFormat(p, p)
+	scanner := bufio.NewReader(bytes.NewReader(normalizeText(p)))
+
+	replaced := make(map[string]struct{})
+	var stack []recoverRegionFrame
+	isSkipping := func() bool {
+		return len(stack) > 0 && stack[len(stack)-1].skipContent
+	}
+
+	var sb strings.Builder
+	var lineno int
+	l, err := util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
+	for err == nil {
+		lineno++
+		marker, ok := getRegionDemarcation(cfg.syntaxes, l)
+		switch {
+		case !ok:
+			if !isSkipping() {
+				sb.WriteString(l)
+				sb.WriteString("\n")
+			}
+		case marker.demarcation == RegionDemarcationStart:
+			if isSkipping() {
+				stack = append(stack, recoverRegionFrame{name: marker.name, skipContent: true})
+				break
+			}
+
+			sb.WriteString(l)
+			sb.WriteString("\n")
+			if content, ok := regs[marker.name]; ok {
+				sb.WriteString(content)
+				replaced[marker.name] = struct{}{}
+				stack = append(stack, recoverRegionFrame{name: marker.name, skipContent: true})
+			} else {
+				stack = append(stack, recoverRegionFrame{name: marker.name})
+			}
+		default:
+			if len(stack) == 0 || (marker.name != "" && marker.name != stack[len(stack)-1].name) {
+				err = errors.New("wrong region demarcation")
+				log.Error().Err(err).Str("name", marker.name).Int("line", lineno).Msg(semLogContext)
+				return nil, nil, err
+			}
+
+			stack = stack[:len(stack)-1]
+			if !isSkipping() {
+				sb.WriteString(l)
+				sb.WriteString("\n")
+			}
+		}
+
+		l, err = util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
+	}
+
+	if err != io.EOF {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, nil, err
+	}
+
+	return tf.Format([]byte(sb.String())), replaced, nil
+}
+
+func regionInventoryFormat(fn string) string {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		return RegionInventoryFormatYAML
+	}
+
+	return RegionInventoryFormatJSON
+}
+
+func relativeTargetPath(targetFolder string, fn string) string {
+	if rel, err := filepath.Rel(targetFolder, fn); err == nil {
+		return rel
+	}
+
+	return fn
+}
+
+// sortedRegions returns the regions in order of appearance.
+func sortedRegions(regs map[string]RegionInfo) []RegionInfo {
+	var out []RegionInfo
+	for _, r := range regs {
+		out = append(out, r)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartLine < out[j].StartLine
+	})
+
+	return out
+}
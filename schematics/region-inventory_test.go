@@ -0,0 +1,55 @@
+package schematics_test
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionInventory(t *testing.T) {
+
+	generated := []byte(`// @tpm-schematics:start-region("custom")
+default
+// @tpm-schematics:end-region("custom")
+// @tpm-schematics:start-region("untouched")
+default
+// @tpm-schematics:end-region("untouched")
+`)
+
+	customized := []byte(`// @tpm-schematics:start-region("custom")
+user code
+// @tpm-schematics:end-region("custom")
+// @tpm-schematics:start-region("untouched")
+default
+// @tpm-schematics:end-region("untouched")
+`)
+
+	store := schematics.NewApplyMemoryStore("/svc-a")
+	_ = store.WriteFile("/svc-a/pkg/main.go", customized)
+	_ = store.WriteFile("/svc-a/README.txt", []byte("no regions\n"))
+
+	inv, err := schematics.ReadRegionInventory(store, schematics.WithRegionInventoryDefaults([]schematics.OpNode{schematics.NewOpNode("pkg/main.go", generated)}))
+	require.NoError(t, err)
+	require.Len(t, inv.Files, 1)
+	require.Equal(t, "pkg/main.go", inv.Files[0].Path)
+	require.Len(t, inv.Files[0].Regions, 2)
+	require.Equal(t, "custom", inv.Files[0].Regions[0].Name)
+	require.True(t, inv.Files[0].Regions[0].Customized)
+	require.False(t, inv.Files[0].Regions[1].Customized)
+
+	b, err := inv.Marshal(schematics.RegionInventoryFormatYAML)
+	require.NoError(t, err)
+	t.Log(string(b))
+
+	inv, err = schematics.UnmarshalRegionInventory(b, schematics.RegionInventoryFormatYAML)
+	require.NoError(t, err)
+
+	// the restructured repo gets the customizations back.
+	target := schematics.NewApplyMemoryStore("/svc-b")
+	_ = target.WriteFile("/svc-b/pkg/main.go", generated)
+	imported, err := schematics.ImportRegionInventory(target, inv)
+	require.NoError(t, err)
+	require.Len(t, imported.Files, 1)
+	require.Equal(t, string(customized), string(target.Files()["/svc-b/pkg/main.go"]))
+}
@@ -0,0 +1,128 @@
+package schematics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RegionAttributeMerge       = "merge"
+	RegionAttributeFingerprint = "fingerprint"
+
+	RegionMergeKeep           = "keep"
+	RegionMergeReplace        = "replace"
+	RegionMergeAppendNewLines = "append-new-lines"
+	RegionMergePrepend        = "prepend"
+	RegionMergeUnion          = "union"
+)
+
+var ErrUnknownRegionMerge = errors.New("unknown region merge strategy")
+
+// mergeRegion computes the content of a region given the marker found in the new content. It returns false if the new content
+// of the region has to be used as is, true if the returned content replaces it.
+func mergeRegion(marker regionMarker, current RegionInfo, isCurrent bool, newRegion RegionInfo) (string, bool, error) {
+	const semLogContext = "schematics::merge-region"
+
+	strategy := marker.attributes[RegionAttributeMerge]
+	if strategy == "" {
+		strategy = RegionMergeKeep
+	}
+
+	if strategy != RegionMergeReplace && isCurrent && current.IsUntouched() {
+		// the current content is the default of a previous generation: the new default takes its place.
+		return "", false, nil
+	}
+
+	switch strategy {
+	case RegionMergeKeep:
+	case RegionMergeReplace:
+		return "", false, nil
+	case RegionMergeAppendNewLines, RegionMergePrepend, RegionMergeUnion:
+		if !isCurrent || current.Size == 0 {
+			return "", false, nil
+		}
+
+		if current.Size != current.OwnSize || newRegion.Size != newRegion.OwnSize {
+			// line based strategies do not apply to regions with nested regions.
+			log.Warn().Str("name", marker.name).Str("merge", strategy).Msg(semLogContext + " - region has nested regions, using " + RegionMergeKeep)
+			break
+		}
+
+		return mergeRegionLines(strategy, current.Content, newRegion.Content), true, nil
+	default:
+		return "", false, fmt.Errorf("%w: %s", ErrUnknownRegionMerge, strategy)
+	}
+
+	if isCurrent && current.OwnSize != 0 {
+		return current.Content, true, nil
+	}
+
+	return "", false, nil
+}
+
+func mergeRegionLines(strategy string, currentContent string, newContent string) string {
+	currentLines := splitRegionLines(currentContent)
+	newLines := splitRegionLines(newContent)
+
+	seen := make(map[string]struct{})
+	var merged []string
+	if strategy == RegionMergeUnion {
+		for _, l := range currentLines {
+			k := strings.TrimSpace(l)
+			if _, ok := seen[k]; ok && k != "" {
+				continue
+			}
+			seen[k] = struct{}{}
+			merged = append(merged, l)
+		}
+	} else {
+		for _, l := range currentLines {
+			seen[strings.TrimSpace(l)] = struct{}{}
+		}
+	}
+
+	var added []string
+	for _, l := range newLines {
+		k := strings.TrimSpace(l)
+		if _, ok := seen[k]; ok || k == "" {
+			continue
+		}
+		seen[k] = struct{}{}
+		added = append(added, l)
+	}
+
+	switch strategy {
+	case RegionMergePrepend:
+		merged = append(added, currentLines...)
+	case RegionMergeUnion:
+		merged = append(merged, added...)
+	default:
+		merged = append(currentLines, added...)
+	}
+
+	var sb strings.Builder
+	for _, l := range merged {
+		sb.WriteString(l)
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func splitRegionLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+func regionFingerprint(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(h[:8])
+}
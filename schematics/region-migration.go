@@ -0,0 +1,92 @@
+package schematics
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RegionMigration renames a region (one From name) or merges several regions into one (more From names) across schematic
+// versions. The migrations are applied to the regions of the current content before they are matched with the new content.
+type RegionMigration struct {
+	From []string `yaml:"from,omitempty" mapstructure:"from,omitempty" json:"from,omitempty"`
+	To   string   `yaml:"to,omitempty" mapstructure:"to,omitempty" json:"to,omitempty"`
+}
+
+// WithRegionMigrations sets the migrations to be applied to the regions of the current content.
+func WithRegionMigrations(migrations ...RegionMigration) RegionOption {
+	return func(opts *RegionOptions) {
+		opts.migrations = append(opts.migrations, migrations...)
+	}
+}
+
+// MigrateRegions applies the migrations to regs and returns the migrated regions together with the migrations actually applied
+// (From lists the names found in regs). A migration is not applied if the target region already exists with content: the
+// regions to be migrated are left untouched. Merged regions are concatenated in the order of the From list and re-indented to the
+// indentation of the first one.
+func MigrateRegions(regs map[string]RegionInfo, migrations []RegionMigration) (map[string]RegionInfo, []RegionMigration) {
+	const semLogContext = "schematics::migrate-regions"
+
+	if len(regs) == 0 || len(migrations) == 0 {
+		return regs, nil
+	}
+
+	out := make(map[string]RegionInfo, len(regs))
+	for k, v := range regs {
+		out[k] = v
+	}
+
+	var applied []RegionMigration
+	for _, m := range migrations {
+		if r, ok := out[m.To]; ok && r.Size != 0 {
+			log.Warn().Str("to", m.To).Strs("from", m.From).Msg(semLogContext + " - target region already has content, migration skipped")
+			continue
+		}
+
+		var found []RegionInfo
+		for _, f := range m.From {
+			if r, ok := out[f]; ok && f != m.To {
+				found = append(found, r)
+			}
+		}
+
+		if len(found) == 0 {
+			continue
+		}
+
+		migrated := RegionInfo{Name: m.To, Parent: found[0].Parent, StartLine: found[0].StartLine, EndLine: found[0].EndLine, Indent: found[0].Indent}
+		var content, ownContent strings.Builder
+		var from []string
+		for _, r := range found {
+			// the merged regions are aligned to the first one: its indentation is the one of the migrated region.
+			from = append(from, r.Name)
+			content.WriteString(reindentRegionContent(r.Content, r.Indent, migrated.Indent))
+			ownContent.WriteString(reindentRegionContent(r.ownContent, r.Indent, migrated.Indent))
+			migrated.Size += r.Size
+			migrated.OwnSize += r.OwnSize
+			delete(out, r.Name)
+		}
+
+		migrated.Content = content.String()
+		migrated.ownContent = ownContent.String()
+		if len(found) == 1 {
+			// a plain rename keeps the attributes (i.e. the fingerprint).
+			migrated.Attributes = found[0].Attributes
+		}
+		out[m.To] = migrated
+
+		for k, v := range out {
+			for _, f := range from {
+				if v.Parent == f {
+					v.Parent = m.To
+					out[k] = v
+				}
+			}
+		}
+
+		log.Info().Str("to", m.To).Strs("from", from).Msg(semLogContext)
+		applied = append(applied, RegionMigration{From: from, To: m.To})
+	}
+
+	return out, applied
+}
@@ -0,0 +1,245 @@
+package schematics
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	RegionDemarcationStart = "start-region"
+	RegionDemarcationEnd   = "end-region"
+
+	RegionSyntaxNameGroup       = "name"
+	RegionSyntaxAttributesGroup = "attrs"
+)
+
+const (
+	regionNamePattern       = `[a-zA-Z0-9\-_.]+`
+	regionAttributesPattern = `(?:\s*,\s*[a-zA-Z0-9\-_]+\s*=\s*"[^"]*")*`
+)
+
+var regionAttributeRegexp = regexp.MustCompile(`([a-zA-Z0-9\-_]+)\s*=\s*"([^"]*)"`)
+
+var RegionDemarcationRegexp = regexp.MustCompile(`@tpm-schematics:(start-region|end-region)\("(` + regionNamePattern + `)"\)`)
+
+// RegionSyntax describes how the start and the end of a region are demarcated in a file.
+// Both the expressions must provide a 'name' named group. The end one can match an empty name: in that case the marker closes
+// the currently open region (i.e. #endregion style markers). The start expression can provide an 'attrs' named group with the
+// key="value" attributes of the region (i.e. merge="union").
+// CommentStart and CommentEnd, if known, are used to produce commented out lines in the files of that type.
+type RegionSyntax struct {
+	Name         string
+	StartRegexp  *regexp.Regexp
+	EndRegexp    *regexp.Regexp
+	CommentStart string
+	CommentEnd   string
+}
+
+// DefaultRegionSyntax matches the @tpm-schematics markers anywhere in a line. It's used for the files whose type is not registered.
+var DefaultRegionSyntax = RegionSyntax{
+	Name:        "tpm-schematics",
+	StartRegexp: regexp.MustCompile(`@tpm-schematics:start-region\("(?P<name>` + regionNamePattern + `)"(?P<attrs>` + regionAttributesPattern + `)\s*\)`),
+	EndRegexp:   regexp.MustCompile(`@tpm-schematics:end-region\("(?P<name>` + regionNamePattern + `)"\)`),
+}
+
+func NewRegionSyntax(name string, startPattern string, endPattern string) (RegionSyntax, error) {
+	rs := RegionSyntax{Name: name}
+
+	var err error
+	rs.StartRegexp, err = regexp.Compile(startPattern)
+	if err != nil {
+		return rs, err
+	}
+
+	rs.EndRegexp, err = regexp.Compile(endPattern)
+	if err != nil {
+		return rs, err
+	}
+
+	if rs.StartRegexp.SubexpIndex(RegionSyntaxNameGroup) < 0 || rs.EndRegexp.SubexpIndex(RegionSyntaxNameGroup) < 0 {
+		return rs, errors.New("region syntax expressions must provide a 'name' group: " + name)
+	}
+
+	return rs, nil
+}
+
+func MustNewRegionSyntax(name string, startPattern string, endPattern string) RegionSyntax {
+	rs, err := NewRegionSyntax(name, startPattern, endPattern)
+	if err != nil {
+		panic(err)
+	}
+
+	return rs
+}
+
+// NewCommentRegionSyntax returns the syntax of the @tpm-schematics markers placed on a line on their own inside a comment
+// (i.e. '// ...', '# ...', '<!-- ... -->'). The commentEnd can be empty for line comments.
+func NewCommentRegionSyntax(commentStart string, commentEnd string) RegionSyntax {
+	return newCommentRegionSyntax(commentStart, commentEnd, `^\s*`)
+}
+
+// NewTrailingCommentRegionSyntax returns the syntax of the @tpm-schematics markers inside a comment that ends the line, on its own or
+// after some code (i.e. 'func a() { // @tpm-schematics:start-region("x")'). A marker followed by anything else, like the closing
+// quote of a string literal, is not recognized.
+func NewTrailingCommentRegionSyntax(commentStart string, commentEnd string) RegionSyntax {
+	return newCommentRegionSyntax(commentStart, commentEnd, "")
+}
+
+func newCommentRegionSyntax(commentStart string, commentEnd string, linePrefix string) RegionSyntax {
+	marker := func(demarcation string) string {
+		p := linePrefix + regexp.QuoteMeta(commentStart) + `\s*@tpm-schematics:` + demarcation + `\("(?P<name>` + regionNamePattern + `)"`
+		if demarcation == RegionDemarcationStart {
+			p += `(?P<attrs>` + regionAttributesPattern + `)\s*`
+		}
+		p += `\)\s*`
+		if commentEnd != "" {
+			p += regexp.QuoteMeta(commentEnd) + `\s*`
+		}
+		return p + `$`
+	}
+
+	rs := MustNewRegionSyntax(strings.TrimSpace(commentStart+" "+commentEnd), marker(RegionDemarcationStart), marker(RegionDemarcationEnd))
+	rs.CommentStart = commentStart
+	rs.CommentEnd = commentEnd
+	return rs
+}
+
+// CommentLine returns the line commented out according to the syntax. The bool is false if the syntax doesn't know how to.
+func (rs RegionSyntax) CommentLine(l string) (string, bool) {
+	if rs.CommentStart == "" {
+		return l, false
+	}
+
+	if rs.CommentEnd == "" {
+		return rs.CommentStart + " " + l, true
+	}
+
+	return rs.CommentStart + " " + l + " " + rs.CommentEnd, true
+}
+
+var (
+	regionSyntaxRegistryMu sync.RWMutex
+	regionSyntaxRegistry   = make(map[string][]RegionSyntax)
+)
+
+func init() {
+	slashSlash := NewTrailingCommentRegionSyntax("//", "")
+	slashStar := NewTrailingCommentRegionSyntax("/*", "*/")
+	hash := NewTrailingCommentRegionSyntax("#", "")
+	xml := NewTrailingCommentRegionSyntax("<!--", "-->")
+	dashDash := NewTrailingCommentRegionSyntax("--", "")
+
+	for _, ext := range []string{".go", ".java", ".js", ".ts", ".kt", ".scala", ".c", ".h", ".cpp", ".cs", ".swift", ".rs", ".proto"} {
+		RegisterRegionSyntax(ext, slashSlash, slashStar)
+	}
+
+	for _, ext := range []string{".yaml", ".yml", ".sh", ".py", ".properties", ".toml", ".rb", ".conf", "Dockerfile", "Makefile"} {
+		RegisterRegionSyntax(ext, hash)
+	}
+
+	for _, ext := range []string{".html", ".htm", ".md", ".xml", ".vue"} {
+		RegisterRegionSyntax(ext, xml)
+	}
+
+	RegisterRegionSyntax(".sql", dashDash)
+}
+
+// RegisterRegionSyntax sets the syntaxes recognized in the files with the given extension (i.e. '.go') or base name
+// (i.e. 'Dockerfile'). The syntaxes are tried in order so custom marker vocabularies can be used alongside the standard one.
+func RegisterRegionSyntax(ext string, syntaxes ...RegionSyntax) {
+	regionSyntaxRegistryMu.Lock()
+	defer regionSyntaxRegistryMu.Unlock()
+
+	if len(syntaxes) == 0 {
+		delete(regionSyntaxRegistry, ext)
+		return
+	}
+
+	regionSyntaxRegistry[ext] = syntaxes
+}
+
+// RegionSyntaxesForFile returns the syntaxes registered for the base name or the extension of fn. The DefaultRegionSyntax is
+// returned if nothing has been registered.
+func RegionSyntaxesForFile(fn string) []RegionSyntax {
+	regionSyntaxRegistryMu.RLock()
+	defer regionSyntaxRegistryMu.RUnlock()
+
+	if s, ok := regionSyntaxRegistry[filepath.Base(fn)]; ok {
+		return s
+	}
+
+	if s, ok := regionSyntaxRegistry[strings.ToLower(filepath.Ext(fn))]; ok {
+		return s
+	}
+
+	return []RegionSyntax{DefaultRegionSyntax}
+}
+
+type regionMarker struct {
+	demarcation string
+	name        string
+	attributes  map[string]string
+}
+
+// getRegionDemarcation returns the type of demarcation, the name and the attributes of the region if the line is a marker.
+func getRegionDemarcation(syntaxes []RegionSyntax, l string) (regionMarker, bool) {
+	for _, s := range syntaxes {
+		if m := s.StartRegexp.FindStringSubmatch(l); m != nil {
+			marker := regionMarker{demarcation: RegionDemarcationStart, name: m[s.StartRegexp.SubexpIndex(RegionSyntaxNameGroup)]}
+			if ndx := s.StartRegexp.SubexpIndex(RegionSyntaxAttributesGroup); ndx >= 0 {
+				for _, am := range regionAttributeRegexp.FindAllStringSubmatch(m[ndx], -1) {
+					if marker.attributes == nil {
+						marker.attributes = make(map[string]string)
+					}
+					marker.attributes[am[1]] = am[2]
+				}
+			}
+			return marker, true
+		}
+
+		if m := s.EndRegexp.FindStringSubmatch(l); m != nil {
+			return regionMarker{demarcation: RegionDemarcationEnd, name: m[s.EndRegexp.SubexpIndex(RegionSyntaxNameGroup)]}, true
+		}
+	}
+
+	return regionMarker{}, false
+}
+
+// setRegionMarkerAttribute sets the attribute in the start marker l. The line is returned unchanged if the syntax of the marker
+// doesn't support attributes.
+func setRegionMarkerAttribute(syntaxes []RegionSyntax, l string, key string, value string) string {
+	for _, s := range syntaxes {
+		loc := s.StartRegexp.FindStringSubmatchIndex(l)
+		if loc == nil {
+			continue
+		}
+
+		ndx := s.StartRegexp.SubexpIndex(RegionSyntaxAttributesGroup)
+		if ndx < 0 || loc[2*ndx] < 0 {
+			return l
+		}
+
+		attrs := l[loc[2*ndx]:loc[2*ndx+1]]
+		var sb strings.Builder
+		found := false
+		for _, am := range regionAttributeRegexp.FindAllStringSubmatch(attrs, -1) {
+			v := am[2]
+			if am[1] == key {
+				v = value
+				found = true
+			}
+			sb.WriteString(", " + am[1] + "=\"" + v + "\"")
+		}
+
+		if !found {
+			sb.WriteString(", " + key + "=\"" + value + "\"")
+		}
+
+		return l[:loc[2*ndx]] + sb.String() + l[loc[2*ndx+1]:]
+	}
+
+	return l
+}
@@ -4,22 +4,158 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-common/util"
 	"github.com/rs/zerolog/log"
 )
 
-const outOfRegion = "out-of-region"
-const inRegion = "in-region"
-const inRegionSkipContent = "in-region-skip-content"
+const (
+	RegionsOfCurrentContent = "current"
+	RegionsOfNewContent     = "new"
+)
 
+// RegionInfo describes a region. Size is the number of lines of the Content while OwnSize doesn't count the lines of the
+// nested regions. Parent is the name of the enclosing region if any. StartLine and EndLine are the lines of the markers.
+// Indent is the indentation of the start marker. Attributes are the key="value" pairs declared in the start marker.
 type RegionInfo struct {
-	Name    string
-	Content string
-	Size    int
+	Name       string
+	Content    string
+	Size       int
+	OwnSize    int
+	Parent     string
+	StartLine  int
+	EndLine    int
+	Indent     string
+	Attributes map[string]string
+
+	ownContent string
+}
+
+// Merge returns the merge strategy declared in the start marker of the region.
+func (ri RegionInfo) Merge() string {
+	if m, ok := ri.Attributes[RegionAttributeMerge]; ok && m != "" {
+		return m
+	}
+
+	return RegionMergeKeep
+}
+
+// Fingerprint returns the fingerprint of the own content of the region (the lines not belonging to nested regions).
+func (ri RegionInfo) Fingerprint() string {
+	return regionFingerprint(ri.ownContent)
+}
+
+// IsUntouched reports if the region has been stamped with a fingerprint that still matches its content.
+func (ri RegionInfo) IsUntouched() bool {
+	fp, ok := ri.Attributes[RegionAttributeFingerprint]
+	return ok && fp != "" && fp == ri.Fingerprint()
+}
+
+// DuplicateRegionError is returned when a region name is declared more than once in the same content.
+// Content is either RegionsOfCurrentContent or RegionsOfNewContent when the error comes from RecoverRegions.
+type DuplicateRegionError struct {
+	Name      string
+	Content   string
+	FirstLine int
+	Line      int
+}
+
+func (e *DuplicateRegionError) Error() string {
+	msg := fmt.Sprintf("duplicate region %q at line %d (first declared at line %d)", e.Name, e.Line, e.FirstLine)
+	if e.Content != "" {
+		msg = msg + " in " + e.Content + " content"
+	}
+
+	return msg
+}
+
+type RegionOptions struct {
+	syntaxes    []RegionSyntax
+	fingerprint bool
+	migrations  []RegionMigration
+	textFormat  *TextFormat
+	reindent    *bool
+	fileName    string
+}
+
+type RegionOption func(*RegionOptions)
+
+// WithRegionSyntax sets the syntaxes used to detect the region markers. If not set the DefaultRegionSyntax is used.
+func WithRegionSyntax(syntaxes ...RegionSyntax) RegionOption {
+	return func(opts *RegionOptions) {
+		opts.syntaxes = syntaxes
+	}
+}
+
+// WithRegionFileName selects the syntaxes registered for the type of the file fn.
+func WithRegionFileName(fn string) RegionOption {
+	return func(opts *RegionOptions) {
+		opts.syntaxes = RegionSyntaxesForFile(fn)
+		opts.fileName = fn
+	}
+}
+
+// WithRegionFingerprint records in the start markers the fingerprint of the default content of the regions. A region whose
+// content still matches its fingerprint has not been edited and gets the new default on the next recovery.
+func WithRegionFingerprint() RegionOption {
+	return func(opts *RegionOptions) {
+		opts.fingerprint = true
+	}
+}
+
+// WithRegionTextFormat normalizes the recovered content to the given format. If not set the line ending style, the final newline
+// state and the BOM of the current content are preserved.
+func WithRegionTextFormat(tf TextFormat) RegionOption {
+	return func(opts *RegionOptions) {
+		opts.textFormat = &tf
+	}
+}
+
+// WithRegionReindent enables or disables the re-indentation of the recovered regions: the content is shifted by the indentation
+// delta between the current and the new start markers. If not set it's enabled for the indentation sensitive files
+// (see IsIndentSensitiveFile) known through WithRegionFileName.
+func WithRegionReindent(enabled bool) RegionOption {
+	return func(opts *RegionOptions) {
+		opts.reindent = &enabled
+	}
+}
+
+func (cfg *RegionOptions) isReindentEnabled() bool {
+	if cfg.reindent != nil {
+		return *cfg.reindent
+	}
+
+	return cfg.fileName != "" && IsIndentSensitiveFile(cfg.fileName)
+}
+
+// outputTextFormat returns the format the recovered content has to be written with.
+func (cfg *RegionOptions) outputTextFormat(fromContent []byte, toContent []byte) TextFormat {
+	if cfg.textFormat != nil {
+		return *cfg.textFormat
+	}
+
+	if len(fromContent) > 0 {
+		return DetectTextFormat(fromContent)
+	}
+
+	return DetectTextFormat(toContent)
+}
+
+func newRegionOptions(opts ...RegionOption) RegionOptions {
+	cfg := RegionOptions{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	if len(cfg.syntaxes) == 0 {
+		cfg.syntaxes = []RegionSyntax{DefaultRegionSyntax}
+	}
+
+	return cfg
 }
 
 /*
@@ -38,23 +174,52 @@ func RecoverRegionsOfFile(fromFile string, toContent []byte) ([]byte, error) {
 	}
 */
 
-func RecoverRegions(fromContent []byte, toContent []byte) ([]byte, error) {
+// RecoverRegions produces the toContent with the regions recovered from fromContent.
+// The line ending style, the final newline state and the BOM of fromContent are preserved unless WithRegionTextFormat is used.
+// The binary files are returned as generated.
+// The recovered regions are re-indented to the new start markers in the indentation sensitive files (see WithRegionReindent).
+// The WithRegionMigrations migrations are applied to the regions of fromContent before they are matched.
+// Each region is merged according to the merge attribute of its start marker in toContent (RegionMergeKeep if not set).
+// A current region whose content matches the fingerprint recorded in its marker has not been edited: the new content is used.
+// Regions can be nested: if the current region has own content (lines not belonging to nested regions) it is kept as a whole
+// together with its nested regions, otherwise the new content is used and the nested regions are recovered one by one.
+func RecoverRegions(fromContent []byte, toContent []byte, opts ...RegionOption) ([]byte, error) {
 	const semLogContext = "schematics::recover-regions"
 
-	regs, err := ReadRegionsFromBuffer(fromContent)
+	cfg := newRegionOptions(opts...)
+	if !isTextContent(cfg.fileName, fromContent, toContent) {
+		log.Trace().Str("file-name", cfg.fileName).Msg(semLogContext + " - binary content")
+		return toContent, nil
+	}
+
+	tf := cfg.outputTextFormat(fromContent, toContent)
+	fromContent, toContent = normalizeText(fromContent), normalizeText(toContent)
+
+	regs, err := readRegionsOfContent(fromContent, RegionsOfCurrentContent, opts...)
 	if err != nil {
 		log.Error().Err(err).Msg(semLogContext)
 		return nil, err
 	}
+	regs, _ = MigrateRegions(regs, cfg.migrations)
 
-	if len(regs) == 0 {
-		return toContent, nil
+	// the new content has to be sound even if there is nothing to recover.
+	newRegs, err := readRegionsOfContent(toContent, RegionsOfNewContent, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	if len(regs) == 0 && !cfg.fingerprint {
+		// nothing to recover: the generated content only takes the format of the existing file.
+		return tf.Format(toContent), nil
 	}
 
 	scanner := bufio.NewReader(bytes.NewReader(toContent))
 
-	status := outOfRegion
-	var currentRegionName string
+	var stack []recoverRegionFrame
+	isSkipping := func() bool {
+		return len(stack) > 0 && stack[len(stack)-1].skipContent
+	}
 
 	lineno := 0
 	l, err := util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
@@ -62,62 +227,61 @@ func RecoverRegions(fromContent []byte, toContent []byte) ([]byte, error) {
 	for err == nil {
 		lineno++
 
-		demarcationType, regionName, isDemarcationLine := getRegionDemarcation(l)
-		switch status {
-		case outOfRegion:
-			if isDemarcationLine {
-				if demarcationType == "start-region" {
-					sb.WriteString(l)
-					sb.WriteString("\n")
-					currentRegionName = regionName
-					if regionInfo, ok := regs[regionName]; ok {
-						if regionInfo.Size != 0 {
-							sb.WriteString(regionInfo.Content)
-							status = inRegionSkipContent
-						} else {
-							status = inRegion
-						}
-					} else {
-						status = inRegion
-					}
-				} else {
-					err = errors.New("wrong region demarcation")
-					log.Error().Err(err).Str("name", regionName).Str("status", status).Str("type", demarcationType).Int("line", lineno).Msg(semLogContext)
-					return nil, err
-				}
-			} else {
+		marker, isDemarcationLine := getRegionDemarcation(cfg.syntaxes, l)
+		switch {
+		case !isDemarcationLine:
+			if !isSkipping() {
 				sb.WriteString(l)
 				sb.WriteString("\n")
 			}
-		case inRegion:
-			if isDemarcationLine {
-				if demarcationType == "end-region" && regionName == currentRegionName {
-					sb.WriteString(l)
-					sb.WriteString("\n")
-					status = outOfRegion
-					currentRegionName = ""
-				} else {
-					err = errors.New("wrong region demarcation")
-					log.Error().Err(err).Str("name", regionName).Str("status", status).Str("type", demarcationType).Int("line", lineno).Msg(semLogContext)
-					return nil, err
+		case marker.demarcation == RegionDemarcationStart:
+			if isSkipping() {
+				// a region nested in a region whose content has been recovered as a whole.
+				stack = append(stack, recoverRegionFrame{name: marker.name, skipContent: true})
+				break
+			}
+
+			currentRegion, isCurrent := regs[marker.name]
+			if isCurrent && cfg.isReindentEnabled() {
+				currentRegion.Content = reindentRegionContent(currentRegion.Content, currentRegion.Indent, lineIndentation(l))
+			}
+
+			content, recovered, err := mergeRegion(marker, currentRegion, isCurrent, newRegs[marker.name])
+			if err != nil {
+				log.Error().Err(err).Str("name", marker.name).Int("line", lineno).Msg(semLogContext)
+				return nil, err
+			}
+
+			if cfg.fingerprint {
+				// the fingerprint is the one of the default content the region has been generated with.
+				fp := newRegs[marker.name].Fingerprint()
+				if recovered {
+					fp = currentRegion.Attributes[RegionAttributeFingerprint]
 				}
-			} else {
+
+				if fp != "" {
+					l = setRegionMarkerAttribute(cfg.syntaxes, l, RegionAttributeFingerprint, fp)
+				}
+			}
+
+			sb.WriteString(l)
+			sb.WriteString("\n")
+			if recovered {
+				sb.WriteString(content)
+			}
+			stack = append(stack, recoverRegionFrame{name: marker.name, skipContent: recovered})
+		default:
+			if len(stack) == 0 || (marker.name != "" && marker.name != stack[len(stack)-1].name) {
+				err = errors.New("wrong region demarcation")
+				log.Error().Err(err).Str("name", marker.name).Int("depth", len(stack)).Str("type", marker.demarcation).Int("line", lineno).Msg(semLogContext)
+				return nil, err
+			}
+
+			stack = stack[:len(stack)-1]
+			if !isSkipping() {
 				sb.WriteString(l)
 				sb.WriteString("\n")
 			}
-		case inRegionSkipContent:
-			if isDemarcationLine {
-				if demarcationType == "end-region" && regionName == currentRegionName {
-					sb.WriteString(l)
-					sb.WriteString("\n")
-					status = outOfRegion
-					currentRegionName = ""
-				} else {
-					err = errors.New("wrong region demarcation")
-					log.Error().Err(err).Str("name", regionName).Str("status", status).Str("type", demarcationType).Int("line", lineno).Msg(semLogContext)
-					return nil, err
-				}
-			}
 		}
 
 		l, err = util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
@@ -128,66 +292,119 @@ func RecoverRegions(fromContent []byte, toContent []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return []byte(sb.String()), nil
+	if len(stack) != 0 {
+		log.Warn().Str("name", stack[len(stack)-1].name).Int("depth", len(stack)).Msg(semLogContext + " - unterminated region")
+	}
+
+	return tf.Format([]byte(sb.String())), nil
+}
+
+func readRegionsOfContent(p []byte, which string, opts ...RegionOption) (map[string]RegionInfo, error) {
+	regs, err := ReadRegionsFromBuffer(p, opts...)
+	if err != nil {
+		var dupErr *DuplicateRegionError
+		if errors.As(err, &dupErr) {
+			dupErr.Content = which
+		}
+		return nil, err
+	}
+
+	return regs, nil
 }
 
-func ReadRegionsFromBuffer(p []byte) (map[string]RegionInfo, error) {
+type recoverRegionFrame struct {
+	name        string
+	skipContent bool
+}
+
+type readRegionFrame struct {
+	name       string
+	sb         strings.Builder
+	own        strings.Builder
+	numLines   int
+	ownLines   int
+	startLine  int
+	indent     string
+	attributes map[string]string
+}
+
+// ReadRegionsFromBuffer returns the regions found in p. The Content of a region includes its nested regions (markers included).
+func ReadRegionsFromBuffer(p []byte, opts ...RegionOption) (map[string]RegionInfo, error) {
 	const semLogContext = "schematics::read-regions-from-buffer"
-	scanner := bufio.NewReader(bytes.NewReader(p))
+
+	cfg := newRegionOptions(opts...)
+	scanner := bufio.NewReader(bytes.NewReader(normalizeText(p)))
 
 	var m map[string]RegionInfo
 
-	status := outOfRegion
-	var regionName string
-	var currentRegionNumLines int
-	var sb strings.Builder
+	declared := make(map[string]int)
+	var stack []*readRegionFrame
+	appendLine := func(l string, own bool) {
+		for _, f := range stack {
+			f.sb.WriteString(l)
+			f.sb.WriteString("\n")
+			f.numLines++
+		}
+
+		if own && len(stack) > 0 {
+			stack[len(stack)-1].own.WriteString(l)
+			stack[len(stack)-1].own.WriteString("\n")
+			stack[len(stack)-1].ownLines++
+		}
+	}
+
 	var lineno int
 	var err error
 	l, err := util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
 	for err == nil {
 		lineno++
-		demarcationType, aName, ok := getRegionDemarcation(l)
-		switch status {
-		case outOfRegion:
-			if ok {
-				if demarcationType == "start-region" {
-					regionName = aName
-					status = inRegion
-				} else {
-					err = errors.New("wrong region demarcation")
-					log.Error().Err(err).Str("name", aName).Str("type", demarcationType).Int("line", lineno).Msg(semLogContext)
-					return nil, err
-				}
-			}
-		case inRegion:
-			if ok {
-				if demarcationType == "end-region" && aName == regionName {
-					if m == nil {
-						m = make(map[string]RegionInfo)
-					}
-
-					rinfo := RegionInfo{
-						Name:    regionName,
-						Size:    currentRegionNumLines,
-						Content: sb.String(),
-					}
-
-					m[regionName] = rinfo
-					sb.Reset()
-					currentRegionNumLines = 0
-
-				} else {
-					err = errors.New("wrong region demarcation")
-					log.Error().Err(err).Str("name", aName).Str("type", demarcationType).Int("line", lineno).Msg(semLogContext)
-					return nil, err
-				}
-				status = outOfRegion
-			} else {
-				sb.WriteString(l)
-				sb.WriteString("\n")
-				currentRegionNumLines++
+		marker, ok := getRegionDemarcation(cfg.syntaxes, l)
+		aName := marker.name
+		switch {
+		case !ok:
+			appendLine(l, true)
+		case marker.demarcation == RegionDemarcationStart:
+			if firstLine, ok := declared[aName]; ok {
+				err = &DuplicateRegionError{Name: aName, FirstLine: firstLine, Line: lineno}
+				log.Error().Err(err).Msg(semLogContext)
+				return nil, err
 			}
+			declared[aName] = lineno
+
+			appendLine(l, false)
+			stack = append(stack, &readRegionFrame{name: aName, startLine: lineno, indent: lineIndentation(l), attributes: marker.attributes})
 		default:
+			if len(stack) == 0 || (aName != "" && aName != stack[len(stack)-1].name) {
+				err = errors.New("wrong region demarcation")
+				log.Error().Err(err).Str("name", aName).Int("depth", len(stack)).Str("type", marker.demarcation).Int("line", lineno).Msg(semLogContext)
+				return nil, err
+			}
+
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if m == nil {
+				m = make(map[string]RegionInfo)
+			}
+
+			rinfo := RegionInfo{
+				Name:       f.name,
+				Size:       f.numLines,
+				OwnSize:    f.ownLines,
+				Content:    f.sb.String(),
+				StartLine:  f.startLine,
+				EndLine:    lineno,
+				Indent:     f.indent,
+				Attributes: f.attributes,
+				ownContent: f.own.String(),
+			}
+
+			if len(stack) > 0 {
+				rinfo.Parent = stack[len(stack)-1].name
+			}
+
+			m[f.name] = rinfo
+			appendLine(l, false)
 		}
 
 		l, err = util.BufoReaderReadLineAsString(scanner, lineno+1, 0)
@@ -201,14 +418,65 @@ func ReadRegionsFromBuffer(p []byte) (map[string]RegionInfo, error) {
 	return m, nil
 }
 
-var RegionDemarcationRegexp = regexp.MustCompile(`@tpm-schematics:(start-region|end-region)\("([a-zA-Z0-9-_]+)"\)`)
+// FindOrphanRegions returns the regions of fromContent that have content but are not declared in toContent: RecoverRegions
+// would drop them. Regions nested in a region that is either kept as a whole or already reported are not returned.
+func FindOrphanRegions(fromContent []byte, toContent []byte, opts ...RegionOption) ([]RegionInfo, error) {
+	const semLogContext = "schematics::find-orphan-regions"
 
-func getRegionDemarcation(l string) (string, string, bool) {
-	matches := RegionDemarcationRegexp.FindAllSubmatch([]byte(l), -1)
+	cfg := newRegionOptions(opts...)
+	current, err := ReadRegionsFromBuffer(fromContent, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+	current, _ = MigrateRegions(current, cfg.migrations)
 
-	for _, m := range matches {
-		return string(m[1]), string(m[2]), true
+	if len(current) == 0 {
+		return nil, nil
 	}
 
-	return "", "", false
+	declared, err := ReadRegionsFromBuffer(toContent, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, err
+	}
+
+	isOrphan := func(r RegionInfo) bool {
+		_, ok := declared[r.Name]
+		return !ok && r.OwnSize != 0
+	}
+
+	var orphans []RegionInfo
+	for _, r := range current {
+		if !isOrphan(r) {
+			continue
+		}
+
+		covered := false
+		for p := r.Parent; p != "" && !covered; p = current[p].Parent {
+			parent := current[p]
+			if _, ok := declared[p]; ok && parent.OwnSize != 0 {
+				// the parent is kept as a whole.
+				covered = true
+			} else if isOrphan(parent) {
+				// the parent is reported with its nested regions.
+				covered = true
+			}
+		}
+
+		if !covered {
+			orphans = append(orphans, r)
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Name < orphans[j].Name
+	})
+
+	return orphans, nil
+}
+
+// StampRegionFingerprints records in the start markers of content the fingerprint of the default content of each region.
+func StampRegionFingerprints(content []byte, opts ...RegionOption) ([]byte, error) {
+	return RecoverRegions(nil, content, append(opts, WithRegionFingerprint())...)
 }
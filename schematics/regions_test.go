@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -61,3 +62,436 @@ func TestMergeRegions(t *testing.T) {
 
 	fmt.Println(string(data))
 }
+
+func TestRecoverRegionsWithSyntax(t *testing.T) {
+
+	// the marker in the string literal is not a region when the go syntax is used.
+	goNew := []byte(`package main
+
+const s = "@tpm-schematics:start-region(\"not-a-region\")"
+
+// @tpm-schematics:start-region("imports")
+// @tpm-schematics:end-region("imports")
+`)
+
+	goCurrent := []byte(`package main
+
+// @tpm-schematics:start-region("imports")
+import "fmt"
+// @tpm-schematics:end-region("imports")
+`)
+
+	data, err := schematics.RecoverRegions(goCurrent, goNew, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "import \"fmt\"")
+
+	// nor is the one in a raw string literal.
+	rawNew := []byte("package main\n\nconst s = `@tpm-schematics:start-region(\"x\")`\nconst e = `@tpm-schematics:end-region(\"x\")`\n\n// @tpm-schematics:start-region(\"imports\")\n// @tpm-schematics:end-region(\"imports\")\n")
+	regs, err := schematics.ReadRegionsFromBuffer(rawNew, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.Contains(t, regs, "imports")
+
+	data, err = schematics.RecoverRegions(goCurrent, rawNew, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "const s = `@tpm-schematics:start-region(\"x\")`\n")
+	require.Contains(t, string(data), "import \"fmt\"")
+
+	// the markers sharing the line with code are still recognized.
+	inlineNew := []byte(`package main
+
+func a() { // @tpm-schematics:start-region("x")
+	generated()
+} // @tpm-schematics:end-region("x")
+`)
+	inlineCurrent := []byte(`package main
+
+func a() { // @tpm-schematics:start-region("x")
+	user()
+} // @tpm-schematics:end-region("x")
+`)
+
+	data, err = schematics.RecoverRegions(inlineCurrent, inlineNew, schematics.WithRegionFileName("a.go"))
+	require.NoError(t, err)
+	require.Equal(t, string(inlineCurrent), string(data))
+
+	yamlNew := []byte(`config:
+  # @tpm-schematics:start-region("custom")
+  # @tpm-schematics:end-region("custom")
+`)
+	yamlCurrent := []byte(`config:
+  # @tpm-schematics:start-region("custom")
+  key: value
+  # @tpm-schematics:end-region("custom")
+`)
+
+	data, err = schematics.RecoverRegions(yamlCurrent, yamlNew, schematics.WithRegionFileName("config.yml"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "  key: value")
+
+	// custom vocabulary where the end marker doesn't carry the name of the region.
+	custom := schematics.MustNewRegionSyntax("region", `^\s*//\s*#region\s+(?P<name>[a-zA-Z0-9\-_]+)\s*$`, `^\s*//\s*#endregion(?P<name>)\s*$`)
+	customNew := []byte(`// #region handlers
+// #endregion
+`)
+	customCurrent := []byte(`// #region handlers
+func handler() {}
+// #endregion
+`)
+
+	regs, err = schematics.ReadRegionsFromBuffer(customCurrent, schematics.WithRegionSyntax(custom))
+	require.NoError(t, err)
+	require.Equal(t, 1, regs["handlers"].Size)
+
+	data, err = schematics.RecoverRegions(customCurrent, customNew, schematics.WithRegionSyntax(custom, schematics.DefaultRegionSyntax))
+	require.NoError(t, err)
+	require.Equal(t, string(customCurrent), string(data))
+}
+
+func TestRecoverNestedRegions(t *testing.T) {
+
+	newNested := []byte(`func (s *Service) Handle() {
+	// @tpm-schematics:start-region("handle")
+	generated := true
+	// @tpm-schematics:start-region("handle-before")
+	// @tpm-schematics:end-region("handle-before")
+	// @tpm-schematics:end-region("handle")
+}
+
+func (s *Service) Close() {
+	// @tpm-schematics:start-region("close")
+	// @tpm-schematics:start-region("close-before")
+	// @tpm-schematics:end-region("close-before")
+	// @tpm-schematics:end-region("close")
+}
+`)
+
+	currentNested := []byte(`func (s *Service) Handle() {
+	// @tpm-schematics:start-region("handle")
+	custom := true
+	// @tpm-schematics:start-region("handle-before")
+	before()
+	// @tpm-schematics:end-region("handle-before")
+	// @tpm-schematics:end-region("handle")
+}
+
+func (s *Service) Close() {
+	// @tpm-schematics:start-region("close")
+	// @tpm-schematics:start-region("close-before")
+	flush()
+	// @tpm-schematics:end-region("close-before")
+	// @tpm-schematics:end-region("close")
+}
+`)
+
+	regs, err := schematics.ReadRegionsFromBuffer(currentNested)
+	require.NoError(t, err)
+	require.Equal(t, 4, regs["handle"].Size)
+	require.Equal(t, 1, regs["handle"].OwnSize)
+	require.Equal(t, "handle", regs["handle-before"].Parent)
+	require.Equal(t, 0, regs["close"].OwnSize)
+
+	data, err := schematics.RecoverRegions(currentNested, newNested)
+	require.NoError(t, err)
+
+	// the outer region with own content is kept as a whole, the other one is regenerated recovering the nested regions.
+	require.Equal(t, string(currentNested), string(data))
+
+	_, err = schematics.ReadRegionsFromBuffer([]byte(`// @tpm-schematics:start-region("a")
+// @tpm-schematics:start-region("b")
+// @tpm-schematics:end-region("a")
+// @tpm-schematics:end-region("b")
+`))
+	require.Error(t, err)
+}
+
+func TestDuplicateRegions(t *testing.T) {
+
+	dup := []byte(`// @tpm-schematics:start-region("sect1")
+first
+// @tpm-schematics:end-region("sect1")
+
+// @tpm-schematics:start-region("sect1")
+second
+// @tpm-schematics:end-region("sect1")
+`)
+
+	single := []byte(`// @tpm-schematics:start-region("sect1")
+// @tpm-schematics:end-region("sect1")
+`)
+
+	_, err := schematics.ReadRegionsFromBuffer(dup)
+	var dupErr *schematics.DuplicateRegionError
+	require.ErrorAs(t, err, &dupErr)
+	require.Equal(t, "sect1", dupErr.Name)
+	require.Equal(t, 1, dupErr.FirstLine)
+	require.Equal(t, 5, dupErr.Line)
+
+	_, err = schematics.RecoverRegions(dup, single)
+	require.ErrorAs(t, err, &dupErr)
+	require.Equal(t, schematics.RegionsOfCurrentContent, dupErr.Content)
+
+	_, err = schematics.RecoverRegions(single, dup)
+	require.ErrorAs(t, err, &dupErr)
+	require.Equal(t, schematics.RegionsOfNewContent, dupErr.Content)
+	t.Log(err)
+}
+
+func TestDuplicateRegionsInNewContentOnly(t *testing.T) {
+	dup := []byte(`// @tpm-schematics:start-region("sect1")
+// @tpm-schematics:end-region("sect1")
+// @tpm-schematics:start-region("sect1")
+// @tpm-schematics:end-region("sect1")
+`)
+
+	_, err := schematics.RecoverRegions([]byte("no regions\n"), dup)
+	var dupErr *schematics.DuplicateRegionError
+	require.ErrorAs(t, err, &dupErr)
+	require.Equal(t, schematics.RegionsOfNewContent, dupErr.Content)
+	require.Equal(t, 3, dupErr.Line)
+}
+
+func TestRecoverRegionsMergeStrategies(t *testing.T) {
+
+	current := []byte(`// @tpm-schematics:start-region("keep")
+user
+// @tpm-schematics:end-region("keep")
+// @tpm-schematics:start-region("replace")
+user
+// @tpm-schematics:end-region("replace")
+// @tpm-schematics:start-region("append")
+import "b"
+import "a"
+// @tpm-schematics:end-region("append")
+// @tpm-schematics:start-region("prepend")
+import "b"
+// @tpm-schematics:end-region("prepend")
+// @tpm-schematics:start-region("union")
+import "b"
+import "b"
+// @tpm-schematics:end-region("union")
+`)
+
+	generated := []byte(`// @tpm-schematics:start-region("keep")
+generated
+// @tpm-schematics:end-region("keep")
+// @tpm-schematics:start-region("replace", merge="replace")
+generated
+// @tpm-schematics:end-region("replace")
+// @tpm-schematics:start-region("append", merge="append-new-lines")
+import "a"
+import "c"
+// @tpm-schematics:end-region("append")
+// @tpm-schematics:start-region("prepend", merge="prepend")
+import "c"
+// @tpm-schematics:end-region("prepend")
+// @tpm-schematics:start-region("union", merge="union")
+import "a"
+import "b"
+// @tpm-schematics:end-region("union")
+`)
+
+	wanted := `// @tpm-schematics:start-region("keep")
+user
+// @tpm-schematics:end-region("keep")
+// @tpm-schematics:start-region("replace", merge="replace")
+generated
+// @tpm-schematics:end-region("replace")
+// @tpm-schematics:start-region("append", merge="append-new-lines")
+import "b"
+import "a"
+import "c"
+// @tpm-schematics:end-region("append")
+// @tpm-schematics:start-region("prepend", merge="prepend")
+import "c"
+import "b"
+// @tpm-schematics:end-region("prepend")
+// @tpm-schematics:start-region("union", merge="union")
+import "b"
+import "a"
+// @tpm-schematics:end-region("union")
+`
+
+	data, err := schematics.RecoverRegions(current, generated, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Equal(t, wanted, string(data))
+
+	regs, err := schematics.ReadRegionsFromBuffer(generated)
+	require.NoError(t, err)
+	require.Equal(t, schematics.RegionMergeUnion, regs["union"].Merge())
+	require.Equal(t, schematics.RegionMergeKeep, regs["keep"].Merge())
+
+	_, err = schematics.RecoverRegions(current, []byte(`// @tpm-schematics:start-region("keep", merge="unknown")
+// @tpm-schematics:end-region("keep")
+`))
+	require.ErrorIs(t, err, schematics.ErrUnknownRegionMerge)
+}
+
+func TestRecoverRegionsFingerprint(t *testing.T) {
+
+	v1 := []byte(`// @tpm-schematics:start-region("untouched")
+default v1
+// @tpm-schematics:end-region("untouched")
+// @tpm-schematics:start-region("edited")
+default v1
+// @tpm-schematics:end-region("edited")
+`)
+
+	v2 := []byte(`// @tpm-schematics:start-region("untouched")
+default v2
+// @tpm-schematics:end-region("untouched")
+// @tpm-schematics:start-region("edited")
+default v2
+// @tpm-schematics:end-region("edited")
+`)
+
+	generated, err := schematics.StampRegionFingerprints(v1, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+
+	regs, err := schematics.ReadRegionsFromBuffer(generated)
+	require.NoError(t, err)
+	require.True(t, regs["untouched"].IsUntouched())
+
+	current := []byte(strings.Replace(string(generated), "default v1\n// @tpm-schematics:end-region(\"edited\")", "user edit\n// @tpm-schematics:end-region(\"edited\")", 1))
+
+	data, err := schematics.RecoverRegions(current, v2, schematics.WithRegionFileName("main.go"), schematics.WithRegionFingerprint())
+	require.NoError(t, err)
+
+	regs, err = schematics.ReadRegionsFromBuffer(data)
+	require.NoError(t, err)
+	require.Equal(t, "default v2\n", regs["untouched"].Content)
+	require.True(t, regs["untouched"].IsUntouched())
+	require.Equal(t, "user edit\n", regs["edited"].Content)
+	require.False(t, regs["edited"].IsUntouched())
+	t.Log(string(data))
+}
+
+func TestRecoverRegionsMigrations(t *testing.T) {
+
+	current := []byte(`// @tpm-schematics:start-region("sect1")
+handler1()
+// @tpm-schematics:end-region("sect1")
+// @tpm-schematics:start-region("imports-a")
+import "a"
+// @tpm-schematics:end-region("imports-a")
+// @tpm-schematics:start-region("imports-b")
+import "b"
+// @tpm-schematics:end-region("imports-b")
+`)
+
+	generated := []byte(`// @tpm-schematics:start-region("handlers-custom")
+// @tpm-schematics:end-region("handlers-custom")
+// @tpm-schematics:start-region("imports")
+// @tpm-schematics:end-region("imports")
+`)
+
+	migrations := []schematics.RegionMigration{
+		{From: []string{"sect1"}, To: "handlers-custom"},
+		{From: []string{"imports-a", "imports-b"}, To: "imports"},
+		{From: []string{"not-there"}, To: "whatever"},
+	}
+
+	data, err := schematics.RecoverRegions(current, generated, schematics.WithRegionMigrations(migrations...))
+	require.NoError(t, err)
+	require.Equal(t, `// @tpm-schematics:start-region("handlers-custom")
+handler1()
+// @tpm-schematics:end-region("handlers-custom")
+// @tpm-schematics:start-region("imports")
+import "a"
+import "b"
+// @tpm-schematics:end-region("imports")
+`, string(data))
+
+	orphans, err := schematics.FindOrphanRegions(current, generated, schematics.WithRegionMigrations(migrations...))
+	require.NoError(t, err)
+	require.Len(t, orphans, 0)
+
+	regs, err := schematics.ReadRegionsFromBuffer(current)
+	require.NoError(t, err)
+	_, applied := schematics.MigrateRegions(regs, migrations)
+	require.Len(t, applied, 2)
+	require.Equal(t, []string{"imports-a", "imports-b"}, applied[1].From)
+}
+
+func TestRecoverRegionsReindent(t *testing.T) {
+
+	current := []byte(`spec:
+  # @tpm-schematics:start-region("env")
+  env:
+    - name: A
+  # @tpm-schematics:end-region("env")
+`)
+
+	generated := []byte(`spec:
+  template:
+    containers:
+      # @tpm-schematics:start-region("env")
+      # @tpm-schematics:end-region("env")
+`)
+
+	expected := `spec:
+  template:
+    containers:
+      # @tpm-schematics:start-region("env")
+      env:
+        - name: A
+      # @tpm-schematics:end-region("env")
+`
+
+	data, err := schematics.RecoverRegions(current, generated, schematics.WithRegionFileName("deployment.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+
+	// and back.
+	data, err = schematics.RecoverRegions(data, current, schematics.WithRegionFileName("deployment.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, string(current), string(data))
+
+	// not indentation sensitive: the content is pasted as is unless asked.
+	goCurrent := []byte("func f() {\n// @tpm-schematics:start-region(\"body\")\nreturn\n// @tpm-schematics:end-region(\"body\")\n}\n")
+	goGenerated := []byte("func f() {\n\t// @tpm-schematics:start-region(\"body\")\n\t// @tpm-schematics:end-region(\"body\")\n}\n")
+
+	data, err = schematics.RecoverRegions(goCurrent, goGenerated, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "\n\t// @tpm-schematics:start-region(\"body\")\nreturn\n")
+
+	data, err = schematics.RecoverRegions(goCurrent, goGenerated, schematics.WithRegionFileName("main.go"), schematics.WithRegionReindent(true))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "\n\t// @tpm-schematics:start-region(\"body\")\n\treturn\n")
+}
+
+func TestRecoverRegionsMigrateReindent(t *testing.T) {
+
+	current := []byte(`a:
+  # @tpm-schematics:start-region("old")
+  c: 2
+  # @tpm-schematics:end-region("old")
+b:
+    # @tpm-schematics:start-region("other")
+    d: 3
+    # @tpm-schematics:end-region("other")
+`)
+
+	generated := []byte(`root:
+  a:
+    # @tpm-schematics:start-region("new")
+    # @tpm-schematics:end-region("new")
+`)
+
+	expected := `root:
+  a:
+    # @tpm-schematics:start-region("new")
+    c: 2
+    # @tpm-schematics:end-region("new")
+`
+
+	// a renamed region is shifted by the indentation delta once.
+	data, err := schematics.RecoverRegions(current, generated, schematics.WithRegionFileName("values.yaml"), schematics.WithRegionMigrations(schematics.RegionMigration{From: []string{"old"}, To: "new"}))
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+
+	// merged regions with different indentations are aligned before being shifted.
+	data, err = schematics.RecoverRegions(current, generated, schematics.WithRegionFileName("values.yaml"), schematics.WithRegionMigrations(schematics.RegionMigration{From: []string{"old", "other"}, To: "new"}))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "    c: 2\n    d: 3\n")
+}
@@ -2,6 +2,8 @@ package schematics_test
 
 import (
 	"embed"
+	"encoding/json"
+	"strings"
 	"testing"
 	"text/template"
 
@@ -85,9 +87,129 @@ func TestApply(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	err = schematics.Apply(
+	_, err = schematics.Apply(
 		src,
 		schematics.WithFilesystemStore("/Users/marioa.imperato/tmp/test-sch"),
 		schematics.WithApplyDefaultConflictMode(schematics.ConflictModeBackup), schematics.WithDeleteOtherFiles("(.yml)|(.yaml)$"))
 	require.NoError(t, err)
 }
+
+func TestApplyOrphanRegions(t *testing.T) {
+
+	current := []byte(`package main
+
+// @tpm-schematics:start-region("kept")
+kept()
+// @tpm-schematics:end-region("kept")
+
+// @tpm-schematics:start-region("removed")
+removed()
+// @tpm-schematics:end-region("removed")
+`)
+
+	generated := []byte(`package main
+
+// @tpm-schematics:start-region("kept")
+// @tpm-schematics:end-region("kept")
+`)
+
+	src := []schematics.OpNode{schematics.NewOpNode("main.go", generated)}
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/main.go", current)
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.NoError(t, err)
+	require.Len(t, res.OrphanRegions, 1)
+	require.Equal(t, "removed", res.OrphanRegions[0].Name)
+	require.Equal(t, "/tmp/main.go.orphans", res.OrphanRegions[0].Sidecar)
+
+	regs, err := schematics.ReadRegionsFromBuffer(store.Files()["/tmp/main.go.orphans"])
+	require.NoError(t, err)
+	require.Equal(t, "removed()\n", regs["removed"].Content)
+
+	// the regions orphaned by a later run are added to the ones already saved.
+	_ = store.WriteFile("/tmp/main.go", []byte(`package main
+
+// @tpm-schematics:start-region("kept")
+kept()
+// @tpm-schematics:end-region("kept")
+`))
+	_, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("main.go", []byte("package main\n"))}, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.NoError(t, err)
+
+	regs, err = schematics.ReadRegionsFromBuffer(store.Files()["/tmp/main.go.orphans"])
+	require.NoError(t, err)
+	require.Len(t, regs, 2)
+	require.Equal(t, "removed()\n", regs["removed"].Content)
+	require.Equal(t, "kept()\n", regs["kept"].Content)
+
+	// a region saved with a different content is not replaced.
+	_ = store.WriteFile("/tmp/main.go", []byte(strings.Replace(string(current), "removed()", "edited()", 1)))
+	_, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("main.go", []byte("package main\n"))}, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.ErrorIs(t, err, schematics.ErrOrphanRegions)
+
+	store = schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/main.go", current)
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyOrphanRegionsMode(schematics.OrphanRegionsModeAppend))
+	require.NoError(t, err)
+	require.Contains(t, string(store.Files()["/tmp/main.go"]), "// removed()\n")
+	require.Contains(t, string(store.Files()["/tmp/main.go"]), "kept()\n")
+
+	store = schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/main.go", current)
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite), schematics.WithApplyOrphanRegionsMode(schematics.OrphanRegionsModeFail))
+	require.ErrorIs(t, err, schematics.ErrOrphanRegions)
+	require.Equal(t, string(current), string(store.Files()["/tmp/main.go"]))
+}
+
+func TestApplyResultFiles(t *testing.T) {
+
+	current := []byte(`package main
+
+// @tpm-schematics:start-region("body")
+custom()
+// @tpm-schematics:end-region("body")
+
+// @tpm-schematics:start-region("untouched")
+// @tpm-schematics:end-region("untouched")
+`)
+
+	generated := []byte(`package main
+
+import "fmt"
+
+// @tpm-schematics:start-region("body")
+// @tpm-schematics:end-region("body")
+
+// @tpm-schematics:start-region("untouched")
+// @tpm-schematics:end-region("untouched")
+`)
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/main.go", current)
+
+	src := []schematics.OpNode{schematics.NewOpNode("main.go", generated), schematics.NewOpNode("new.txt", []byte("a\nb\n"))}
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeBackup))
+	require.NoError(t, err)
+	require.Len(t, res.Files, 2)
+
+	mainGo := res.Files[0]
+	require.Equal(t, "/tmp/main.go", mainGo.Path)
+	require.Equal(t, schematics.PlanActionBackupOverwrite, mainGo.Action)
+	require.Equal(t, schematics.ConflictModeBackup, mainGo.ConflictMode)
+	require.Equal(t, schematics.ConflictRuleDefault, mainGo.ConflictRule)
+	require.Equal(t, len(current), mainGo.PreviousSize)
+	require.Equal(t, 2, mainGo.LinesAdded)
+	require.Equal(t, 0, mainGo.LinesRemoved)
+	require.Equal(t, []string{"body"}, mainGo.RecoveredRegions)
+	require.Equal(t, []string{"/tmp/main.go.bak"}, mainGo.Artifacts)
+
+	newTxt := res.Files[1]
+	require.Equal(t, schematics.PlanActionCreate, newTxt.Action)
+	require.Equal(t, schematics.ConflictRuleNewFile, newTxt.ConflictRule)
+	require.Equal(t, 2, newTxt.LinesAdded)
+
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"recovered-regions":["body"]`)
+}
@@ -14,10 +14,11 @@ import (
 )
 
 type SourceTemplateOptions struct {
-	funcMap    template.FuncMap
-	formatCode bool
-	model      interface{}
-	metadata   map[string]interface{}
+	funcMap      template.FuncMap
+	formatCode   bool
+	nameEscaping bool
+	model        interface{}
+	metadata     map[string]interface{}
 
 	foldersIncludeList []string
 	foldersIgnoreList  []string
@@ -33,6 +34,13 @@ func SourceWithFormatCode() SourceTemplateOption {
 	}
 }
 
+// SourceWithNameEscaping enables the dot- and underscore- escaping of the template paths (i.e. dot-gitignore.tmpl --> .gitignore).
+func SourceWithNameEscaping() SourceTemplateOption {
+	return func(aopts *SourceTemplateOptions) {
+		aopts.nameEscaping = true
+	}
+}
+
 func SourceWithModel(m interface{}) SourceTemplateOption {
 	return func(aopts *SourceTemplateOptions) {
 		aopts.model = m
@@ -150,12 +158,19 @@ func (s *SourceTemplate) processTemplates(genCtx *SourceContext, funcMap templat
 	var err error
 	var out OpNode
 
-	out.Path, err = ResolveSchematicsName(s.path, genCtx.Metadata)
+	resolvedPath, ok, err := ResolveSchematicsPath(s.path, genCtx.nameProperties())
 	if err != nil {
 		log.Error().Err(err).Msg(semLogContext)
 		return out, err
 	}
 
+	if !ok {
+		// one of the segments of the path resolved to empty: the file is not part of the output.
+		log.Info().Str("path", s.path).Msg(semLogContext + " - path resolved to empty segment, skipping")
+		return OpNode{}, nil
+	}
+	out.Path = resolvedPath
+
 	if !s.IsGoLanguage() {
 		formatCode = false
 	}
@@ -203,6 +218,8 @@ func GetSource(templates embed.FS, embedRootFolder string, opts ...SourceTemplat
 		log.Info().Str("path", n.path).Interface("tmpls", n.TemplateNames()).Msg(semLogContext)
 	}
 
+	warnOnMissingHiddenFiles(embedRootFolder, nodes)
+
 	n, ok := cfg.metadata["name"]
 	if !ok {
 		n, ok = cfg.metadata["Name"]
@@ -232,12 +249,49 @@ func processSourceTemplates(ctx *SourceContext, funcMap template.FuncMap, nodes
 			return nil, err
 		}
 
+		if o.IsZero() {
+			continue
+		}
+
 		opNodes = append(opNodes, o)
 	}
 
 	return opNodes, nil
 }
 
+// hiddenFilesCompanions are files that usually come together with hidden ones (.gitignore, .dockerignore, .golangci.yml,...).
+var hiddenFilesCompanions = map[string]struct{}{
+	"go.mod":       {},
+	"package.json": {},
+	"pom.xml":      {},
+	"Dockerfile":   {},
+	"Makefile":     {},
+}
+
+// warnOnMissingHiddenFiles logs a warning if the templates look like a project tree but no hidden file has been found.
+// embed.FS silently drops the files starting with '.' or '_' unless the all: prefix is used: the e(__dot__) placeholder or the
+// dot- and underscore- escaping prefixes (see SourceWithNameEscaping) should be used instead.
+func warnOnMissingHiddenFiles(embedRootFolder string, nodes []SourceTemplate) {
+	const semLogContext = "schematics::warn-on-missing-hidden-files"
+
+	var companion string
+	for _, n := range nodes {
+		for _, seg := range strings.Split(n.path, "/") {
+			if isHiddenOrEscapedSegment(seg) {
+				return
+			}
+		}
+
+		if _, ok := hiddenFilesCompanions[filepath.Base(n.path)]; ok && companion == "" {
+			companion = n.path
+		}
+	}
+
+	if companion != "" {
+		log.Warn().Str("embed-root", embedRootFolder).Str("companion", companion).Msg(semLogContext + " - no hidden files found: use the all: embed prefix, the e(__dot__) placeholder or the dot- name escaping")
+	}
+}
+
 func readSourceTemplates(cfg *SourceTemplateOptions, templates embed.FS, rootFolder string) ([]SourceTemplate, error) {
 	const semLogContext = "schematics::read-source-templates"
 
@@ -293,6 +347,10 @@ func readSourceTemplates(cfg *SourceTemplateOptions, templates embed.FS, rootFol
 			fulln = filepath.Join(e.Path, baseFn)
 		}
 
+		if cfg.nameEscaping {
+			fulln = UnescapeSchematicsName(fulln)
+		}
+
 		if ndx, ok := treeNodeMap[fulln]; ok {
 			if !treeNodes[ndx].isRealTemplate || !isTemplate {
 				// For some reason I got something that matches a non template file.
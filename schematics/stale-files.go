@@ -0,0 +1,114 @@
+package schematics
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	StaleFilesModeReport     = "report"
+	StaleFilesModeDelete     = "delete"
+	StaleFilesModeRename     = "rename"
+	StaleFilesModeQuarantine = "quarantine"
+
+	StaleFilesRenameSuffix          = ".del"
+	StaleFilesQuarantineFolder      = ".tpm-schematics-quarantine"
+	staleFilesGeneratedFileEvidence = "@tpm-schematics:"
+)
+
+// staleFilesArtifactSuffixes are the companion files produced by Apply: they are never considered stale (like the files of the
+// quarantine, shadow and staging folders).
+var staleFilesArtifactSuffixes = []string{".bak", ".patch", ".new", ".orphans", StaleFilesRenameSuffix}
+
+// IsGeneratedFile reports if p carries the evidence of having been generated: region, generated-block or checksum markers.
+func IsGeneratedFile(p []byte) bool {
+	return bytes.Contains(p, []byte(staleFilesGeneratedFileEvidence))
+}
+
+// planStaleFile returns the action for a file of the target folder that is not produced by the current generation. Only the files
+// generated by a previous run are deleted, renamed or quarantined: the ones recorded, unchanged, in the previous manifest or, if there
+// is no manifest, the ones carrying markers. The others are reported.
+func planStaleFile(cfg *ApplyOptions, fn string) (PlannedAction, bool, error) {
+	const semLogContext = "schematics::plan-stale-file"
+
+	for _, sfx := range staleFilesArtifactSuffixes {
+		if strings.HasSuffix(fn, sfx) {
+			return PlannedAction{}, false, nil
+		}
+	}
+
+	if fn == filepath.Join(cfg.writer.TargetFolder(), ManifestFileName) {
+		return PlannedAction{}, false, nil
+	}
+
+	quarantineFolder := cfg.staleFilesQuarantineFolder()
+	if strings.HasPrefix(fn, quarantineFolder+string(filepath.Separator)) || strings.HasPrefix(fn, cfg.shadowFolderPath()+string(filepath.Separator)) {
+		return PlannedAction{}, false, nil
+	}
+
+	// a staging folder left by an incomplete rollback holds the only copy of the replaced files.
+	if strings.HasPrefix(relativeTargetPath(cfg.writer.TargetFolder(), fn), StagingFolderPrefix) {
+		return PlannedAction{}, false, nil
+	}
+
+	action := PlannedAction{Path: fn, Action: PlanActionStale}
+	if cfg.staleFilesMode == "" || cfg.staleFilesMode == StaleFilesModeReport {
+		log.Info().Str("file-name", fn).Msg(semLogContext + " file not in current generation")
+		return action, true, nil
+	}
+
+	p, err := cfg.writer.ReadFile(fn)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return action, false, err
+	}
+
+	if cfg.previousManifest != nil {
+		// the manifest is the record of what has been generated: a copy of a generated file carries the markers as well.
+		mf, isInManifest := cfg.previousManifest.File(relativeTargetPath(cfg.writer.TargetFolder(), fn))
+		if !isInManifest {
+			log.Warn().Str("file-name", fn).Msg(semLogContext + " file not in current generation is not in the manifest, reporting only")
+			return action, true, nil
+		}
+
+		if mf.Hash != "" && mf.Hash != contentHash(p) {
+			log.Warn().Str("file-name", fn).Msg(semLogContext + " file not in current generation has been edited since the previous generation, reporting only")
+			return action, true, nil
+		}
+	} else if !IsGeneratedFile(p) {
+		log.Warn().Str("file-name", fn).Msg(semLogContext + " file not in current generation has not been generated, reporting only")
+		return action, true, nil
+	}
+
+	switch cfg.staleFilesMode {
+	case StaleFilesModeDelete:
+		action.Action = PlanActionDelete
+	case StaleFilesModeRename:
+		action.Action = PlanActionRename
+		action.MoveTo = fn + StaleFilesRenameSuffix
+	case StaleFilesModeQuarantine:
+		action.Action = PlanActionQuarantine
+		action.MoveTo = filepath.Join(quarantineFolder, relativeTargetPath(cfg.writer.TargetFolder(), fn))
+	default:
+		log.Warn().Str("file-name", fn).Str("mode", cfg.staleFilesMode).Msg(semLogContext + " unknown stale files mode, reporting only")
+	}
+
+	log.Info().Str("file-name", fn).Str("action", action.Action).Msg(semLogContext + " file not in current generation")
+	return action, true, nil
+}
+
+func (cfg *ApplyOptions) staleFilesQuarantineFolder() string {
+	folder := cfg.quarantineFolder
+	if folder == "" {
+		folder = StaleFilesQuarantineFolder
+	}
+
+	if !filepath.IsAbs(folder) {
+		folder = filepath.Join(cfg.writer.TargetFolder(), folder)
+	}
+
+	return folder
+}
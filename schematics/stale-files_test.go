@@ -0,0 +1,105 @@
+package schematics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyStaleFiles(t *testing.T) {
+
+	generated := []byte("// @tpm-schematics:start-region(\"body\")\n// @tpm-schematics:end-region(\"body\")\n")
+	src := []schematics.OpNode{schematics.NewOpNode("main.go", generated)}
+
+	newStore := func() *schematics.ApplyMemoryStore {
+		store := schematics.NewApplyMemoryStore("/tmp")
+		_ = store.WriteFile("/tmp/old.go", generated)
+		_ = store.WriteFile("/tmp/user.go", []byte("package user\n"))
+		_ = store.WriteFile("/tmp/main.go.bak", generated)
+		return store
+	}
+
+	store := newStore()
+	res, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeDelete))
+	require.NoError(t, err)
+	require.False(t, store.FileExists("/tmp/old.go"))
+	require.True(t, store.FileExists("/tmp/user.go"))
+	require.True(t, store.FileExists("/tmp/main.go.bak"))
+
+	actions := make(map[string]string)
+	for _, f := range res.Files {
+		actions[f.Path] = f.Action
+	}
+	require.Equal(t, map[string]string{"/tmp/main.go": schematics.PlanActionCreate, "/tmp/old.go": schematics.PlanActionDelete, "/tmp/user.go": schematics.PlanActionStale}, actions)
+
+	store = newStore()
+	_, err = schematics.Apply(src, schematics.WithStore(store), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeRename))
+	require.NoError(t, err)
+	require.True(t, store.FileExists("/tmp/old.go.del"))
+
+	// the quarantine keeps the layout of the target folder and empty folders get removed.
+	targetFolder := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(targetFolder, "pkg", "old"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(targetFolder, "pkg", "old", "old.go"), generated, os.ModePerm))
+
+	res, err = schematics.Apply(src, schematics.WithFilesystemStore(targetFolder), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeQuarantine))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(targetFolder, schematics.StaleFilesQuarantineFolder, "pkg", "old", "old.go"))
+	require.NoDirExists(t, filepath.Join(targetFolder, "pkg"))
+	require.Equal(t, filepath.Join(targetFolder, schematics.StaleFilesQuarantineFolder, "pkg", "old", "old.go"), res.Files[1].MovedTo)
+
+	// the quarantined files are not stale.
+	res, err = schematics.Apply(src, schematics.WithFilesystemStore(targetFolder), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeDelete))
+	require.NoError(t, err)
+	require.Len(t, res.Files, 1)
+}
+
+func TestApplyStaleFilesFlat(t *testing.T) {
+
+	generated := []byte("// @tpm-schematics:start-region(\"body\")\n// @tpm-schematics:end-region(\"body\")\n")
+
+	// the file written in flat mode is not stale.
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/main.go", generated)
+	_ = store.WriteFile("/tmp/old.go", generated)
+
+	res, err := schematics.Apply([]schematics.OpNode{schematics.NewOpNode("cmd/main.go", generated)}, schematics.WithStore(store), schematics.WithFlat(true), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeDelete))
+	require.NoError(t, err)
+	require.True(t, store.FileExists("/tmp/main.go"))
+	require.False(t, store.FileExists("/tmp/old.go"))
+	require.Len(t, res.Files, 2)
+}
+
+func TestApplyStaleFilesManifest(t *testing.T) {
+
+	generated := []byte("// @tpm-schematics:start-region(\"body\")\n// @tpm-schematics:end-region(\"body\")\n")
+	src := []schematics.OpNode{
+		schematics.NewOpNode("h1.go", generated),
+		schematics.NewOpNode("h2.go", generated),
+		schematics.NewOpNode("h3.go", generated),
+	}
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_, err := schematics.Apply(src, schematics.WithStore(store), schematics.WithApplyManifest("go-service", "1.0.0"))
+	require.NoError(t, err)
+
+	// with a manifest the markers are not an evidence: the copy of a generated file and the edited files are only reported.
+	_ = store.WriteFile("/tmp/h2_user.go", generated)
+	_ = store.WriteFile("/tmp/h3.go", append(generated, []byte("edited()\n")...))
+	res, err := schematics.Apply(src[:1], schematics.WithStore(store), schematics.WithApplyManifest("go-service", "1.0.0"), schematics.WithDeleteOtherFiles(""), schematics.WithApplyStaleFilesMode(schematics.StaleFilesModeDelete))
+	require.NoError(t, err)
+	require.False(t, store.FileExists("/tmp/h2.go"))
+	require.True(t, store.FileExists("/tmp/h2_user.go"))
+	require.True(t, store.FileExists("/tmp/h3.go"))
+
+	actions := make(map[string]string)
+	for _, f := range res.Files {
+		actions[f.Path] = f.Action
+	}
+	require.Equal(t, schematics.PlanActionDelete, actions["/tmp/h2.go"])
+	require.Equal(t, schematics.PlanActionStale, actions["/tmp/h2_user.go"])
+	require.Equal(t, schematics.PlanActionStale, actions["/tmp/h3.go"])
+}
@@ -0,0 +1,243 @@
+package schematics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	StructuredMergeConflictKeepCurrent  = "current"
+	StructuredMergeConflictUseGenerated = "generated"
+)
+
+// MergeStructuredSource deep merges a JSON or YAML document (depending on the extension of fn) edited by the user with the
+// newly generated one. The keys found only in the current document are kept, the keys found only in the generated document are
+// added and the conflicting values (scalars, sequences or values of different kinds) are resolved according to conflictRule.
+// The key order of the current document and the YAML comments are preserved.
+func MergeStructuredSource(fn string, currentContent []byte, generatedContent []byte, conflictRule string) ([]byte, error) {
+	const semLogContext = "schematics::merge-structured-source"
+
+	if conflictRule == "" {
+		conflictRule = StructuredMergeConflictKeepCurrent
+	}
+
+	currentDocs, err := decodeStructuredDocuments(currentContent)
+	if err != nil {
+		log.Error().Err(err).Str("fn", fn).Msg(semLogContext)
+		return nil, err
+	}
+
+	generatedDocs, err := decodeStructuredDocuments(generatedContent)
+	if err != nil {
+		log.Error().Err(err).Str("fn", fn).Msg(semLogContext)
+		return nil, err
+	}
+
+	if len(currentDocs) == 0 {
+		return generatedContent, nil
+	}
+
+	for i := range currentDocs {
+		if i < len(generatedDocs) {
+			currentDocs[i] = mergeStructuredNodes(currentDocs[i], generatedDocs[i], conflictRule)
+		}
+	}
+
+	if len(generatedDocs) > len(currentDocs) {
+		currentDocs = append(currentDocs, generatedDocs[len(currentDocs):]...)
+	}
+
+	if strings.ToLower(filepath.Ext(fn)) == ".json" {
+		return encodeJSONDocument(currentDocs[0], currentContent)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(detectIndent(currentContent, 2))
+	for _, d := range currentDocs {
+		if err = enc.Encode(d); err != nil {
+			log.Error().Err(err).Str("fn", fn).Msg(semLogContext)
+			return nil, err
+		}
+	}
+
+	if err = enc.Close(); err != nil {
+		log.Error().Err(err).Str("fn", fn).Msg(semLogContext)
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeStructuredDocuments(p []byte) ([]*yaml.Node, error) {
+	var docs []*yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(p))
+	for {
+		var n yaml.Node
+		err := dec.Decode(&n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, &n)
+	}
+
+	return docs, nil
+}
+
+func mergeStructuredNodes(current *yaml.Node, generated *yaml.Node, conflictRule string) *yaml.Node {
+	switch {
+	case current.Kind == yaml.DocumentNode && generated.Kind == yaml.DocumentNode:
+		if len(current.Content) > 0 && len(generated.Content) > 0 {
+			current.Content[0] = mergeStructuredNodes(current.Content[0], generated.Content[0], conflictRule)
+		}
+		return current
+	case current.Kind == yaml.MappingNode && generated.Kind == yaml.MappingNode:
+		currentKeys := make(map[string]int)
+		for i := 0; i+1 < len(current.Content); i += 2 {
+			currentKeys[current.Content[i].Value] = i
+		}
+
+		for i := 0; i+1 < len(generated.Content); i += 2 {
+			k := generated.Content[i].Value
+			if ndx, ok := currentKeys[k]; ok {
+				current.Content[ndx+1] = mergeStructuredNodes(current.Content[ndx+1], generated.Content[i+1], conflictRule)
+			} else {
+				current.Content = append(current.Content, generated.Content[i], generated.Content[i+1])
+			}
+		}
+		return current
+	}
+
+	if conflictRule == StructuredMergeConflictUseGenerated {
+		// the comments of the user are kept if the generated value doesn't bring its own.
+		if generated.HeadComment == "" {
+			generated.HeadComment = current.HeadComment
+		}
+		if generated.LineComment == "" {
+			generated.LineComment = current.LineComment
+		}
+		if generated.FootComment == "" {
+			generated.FootComment = current.FootComment
+		}
+		return generated
+	}
+
+	return current
+}
+
+var indentRegexp = regexp.MustCompile(`(?m)^([ \t]+)\S`)
+
+func detectIndent(p []byte, defaultIndent int) int {
+	if m := indentRegexp.FindSubmatch(p); m != nil && !bytes.Contains(m[1], []byte("\t")) {
+		return len(m[1])
+	}
+
+	return defaultIndent
+}
+
+// encodeJSONDocument writes the document as JSON keeping the key order and the indentation style of the current content.
+func encodeJSONDocument(doc *yaml.Node, currentContent []byte) ([]byte, error) {
+	indent := "  "
+	if m := indentRegexp.FindSubmatch(currentContent); m != nil {
+		indent = string(m[1])
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSONNode(&buf, doc, indent, ""); err != nil {
+		return nil, err
+	}
+
+	if bytes.HasSuffix(currentContent, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeJSONNode(buf *bytes.Buffer, n *yaml.Node, indent string, prefix string) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil
+		}
+		return writeJSONNode(buf, n.Content[0], indent, prefix)
+	case yaml.AliasNode:
+		return writeJSONNode(buf, n.Alias, indent, prefix)
+	case yaml.MappingNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+
+		buf.WriteString("{\n")
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			buf.WriteString(prefix + indent)
+			if err := writeJSONString(buf, n.Content[i].Value); err != nil {
+				return err
+			}
+			buf.WriteString(": ")
+			if err := writeJSONNode(buf, n.Content[i+1], indent, prefix+indent); err != nil {
+				return err
+			}
+			if i+2 < len(n.Content) {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(prefix + "}")
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+
+		buf.WriteString("[\n")
+		for i, c := range n.Content {
+			buf.WriteString(prefix + indent)
+			if err := writeJSONNode(buf, c, indent, prefix+indent); err != nil {
+				return err
+			}
+			if i+1 < len(n.Content) {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(prefix + "]")
+	default:
+		switch n.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+		case "!!bool", "!!int", "!!float":
+			buf.WriteString(n.Value)
+		default:
+			return writeJSONString(buf, n.Value)
+		}
+	}
+
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+
+	// the encoder terminates each value with a newline.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
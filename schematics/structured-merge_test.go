@@ -0,0 +1,81 @@
+package schematics_test
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeStructuredSourceYAML(t *testing.T) {
+
+	current := []byte(`# service configuration
+config:
+  # the port has been changed by the user
+  port: 9090
+  user-key: user-value
+  tags: [a, b]
+`)
+
+	generated := []byte(`config:
+  port: 8080
+  timeout: 30s
+  tags: [c]
+log:
+  level: info
+`)
+
+	data, err := schematics.MergeStructuredSource("config.yaml", current, generated, "")
+	require.NoError(t, err)
+	t.Log(string(data))
+
+	require.Equal(t, `# service configuration
+config:
+  # the port has been changed by the user
+  port: 9090
+  user-key: user-value
+  tags: [a, b]
+  timeout: 30s
+log:
+  level: info
+`, string(data))
+
+	data, err = schematics.MergeStructuredSource("config.yaml", current, generated, schematics.StructuredMergeConflictUseGenerated)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "  # the port has been changed by the user\n  port: 8080\n")
+	require.Contains(t, string(data), "tags: [c]")
+}
+
+func TestMergeStructuredSourceJSON(t *testing.T) {
+
+	current := []byte(`{
+    "name": "my-app",
+    "version": "1.2.0",
+    "scripts": {
+        "custom": "echo <custom>"
+    }
+}
+`)
+
+	generated := []byte(`{
+  "name": "my-app",
+  "version": "1.0.0",
+  "private": true,
+  "scripts": {
+    "build": "tsc"
+  }
+}`)
+
+	data, err := schematics.MergeStructuredSource("package.json", current, generated, "")
+	require.NoError(t, err)
+	require.Equal(t, `{
+    "name": "my-app",
+    "version": "1.2.0",
+    "scripts": {
+        "custom": "echo <custom>",
+        "build": "tsc"
+    },
+    "private": true
+}
+`, string(data))
+}
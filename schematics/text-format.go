@@ -0,0 +1,85 @@
+package schematics
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// TextFormat is the line ending style, the final newline state and the presence of the UTF-8 BOM of a text file.
+type TextFormat struct {
+	LineEnding   string `yaml:"line-ending,omitempty" mapstructure:"line-ending,omitempty" json:"line-ending,omitempty"`
+	FinalNewline bool   `yaml:"final-newline,omitempty" mapstructure:"final-newline,omitempty" json:"final-newline,omitempty"`
+	BOM          bool   `yaml:"bom,omitempty" mapstructure:"bom,omitempty" json:"bom,omitempty"`
+}
+
+// DetectTextFormat detects the format of p. The line ending is the one used by the majority of the lines.
+func DetectTextFormat(p []byte) TextFormat {
+	tf := TextFormat{LineEnding: LineEndingLF, BOM: bytes.HasPrefix(p, utf8BOM)}
+
+	numLines := bytes.Count(p, []byte("\n"))
+	numCRLF := bytes.Count(p, []byte("\r\n"))
+	if numCRLF > 0 && numCRLF*2 >= numLines {
+		tf.LineEnding = LineEndingCRLF
+	}
+
+	tf.FinalNewline = bytes.HasSuffix(p, []byte("\n"))
+	return tf
+}
+
+// isTextContent reports if the contents of the file fn can be handled as text: the binary file types (see SourceTemplate.IsBinary)
+// and the contents that are not valid UTF-8 are left untouched by the text format handling.
+func isTextContent(fn string, contents ...[]byte) bool {
+	if _, ok := binaryExtensions[strings.ToLower(filepath.Ext(fn))]; ok {
+		return false
+	}
+
+	for _, p := range contents {
+		if !utf8.Valid(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeText removes the BOM and turns the CRLF line endings into LF.
+func normalizeText(p []byte) []byte {
+	p = bytes.TrimPrefix(p, utf8BOM)
+	if bytes.Contains(p, []byte("\r\n")) {
+		p = bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n"))
+	}
+
+	return p
+}
+
+// Format turns the LF normalized content p into the format.
+func (tf TextFormat) Format(p []byte) []byte {
+	p = normalizeText(p)
+
+	if tf.FinalNewline {
+		if len(p) > 0 && !bytes.HasSuffix(p, []byte("\n")) {
+			p = append(p, '\n')
+		}
+	} else {
+		p = bytes.TrimSuffix(p, []byte("\n"))
+	}
+
+	if tf.LineEnding == LineEndingCRLF {
+		p = bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))
+	}
+
+	if tf.BOM {
+		p = append(append([]byte{}, utf8BOM...), p...)
+	}
+
+	return p
+}
@@ -0,0 +1,53 @@
+package schematics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverRegionsTextFormat(t *testing.T) {
+
+	generated := []byte("// @tpm-schematics:start-region(\"sect1\")\n// @tpm-schematics:end-region(\"sect1\")\ngenerated\n")
+
+	current := "\xEF\xBB\xBF// @tpm-schematics:start-region(\"sect1\")\r\nuser\r\n// @tpm-schematics:end-region(\"sect1\")\r\ngenerated"
+
+	data, err := schematics.RecoverRegions([]byte(current), generated, schematics.WithRegionFileName("main.go"))
+	require.NoError(t, err)
+	require.Equal(t, current, string(data))
+
+	tf := schematics.DetectTextFormat([]byte(current))
+	require.Equal(t, schematics.TextFormat{LineEnding: schematics.LineEndingCRLF, FinalNewline: false, BOM: true}, tf)
+
+	data, err = schematics.RecoverRegions([]byte(current), generated, schematics.WithRegionFileName("main.go"), schematics.WithRegionTextFormat(schematics.TextFormat{LineEnding: schematics.LineEndingLF, FinalNewline: true}))
+	require.NoError(t, err)
+	require.Equal(t, strings.ReplaceAll(strings.TrimPrefix(current, "\xEF\xBB\xBF"), "\r\n", "\n")+"\n", string(data))
+
+	// files without regions keep the format as well.
+	data, err = schematics.RecoverRegions([]byte("a\r\nb\r\n"), []byte("a\nb\nc\n"))
+	require.NoError(t, err)
+	require.Equal(t, "a\r\nb\r\nc\r\n", string(data))
+
+	// a CRLF file whose content is the generated one is left unchanged.
+	store := schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/a.txt", []byte("a\r\nb\r\n"))
+	res, err := schematics.Apply([]schematics.OpNode{schematics.NewOpNode("a.txt", []byte("a\nb\n"))}, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeBackup))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionUnchanged, res.Files[0].Action)
+	require.Len(t, store.Files(), 1)
+
+	// binary files are never touched.
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\xff\xd8")
+	data, err = schematics.RecoverRegions(png, png, schematics.WithRegionFileName("logo.png"), schematics.WithRegionTextFormat(schematics.TextFormat{LineEnding: schematics.LineEndingCRLF}))
+	require.NoError(t, err)
+	require.Equal(t, png, data)
+
+	store = schematics.NewApplyMemoryStore("/tmp")
+	_ = store.WriteFile("/tmp/logo.png", png)
+	res, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("logo.png", png)}, schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeOverwrite))
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionUnchanged, res.Files[0].Action)
+	require.Equal(t, png, store.Files()["/tmp/logo.png"])
+}
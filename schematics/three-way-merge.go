@@ -0,0 +1,407 @@
+package schematics
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ConflictMarkerCurrent   = "<<<<<<< current"
+	ConflictMarkerSeparator = "======="
+	ConflictMarkerGenerated = ">>>>>>> generated"
+
+	ShadowFolder = ".tpm-schematics-shadow"
+)
+
+// ThreeWayMerge merges the changes made by the user (base to currentContent) with the ones of the new generation (base to
+// generatedContent). The changes of one side only are applied while the lines changed by both sides in different ways are written
+// between git-style conflict markers. The number of conflicts is returned. The text format of currentContent is preserved.
+func ThreeWayMerge(baseContent []byte, currentContent []byte, generatedContent []byte) ([]byte, int) {
+	tf := DetectTextFormat(currentContent)
+	if len(currentContent) == 0 {
+		tf = DetectTextFormat(generatedContent)
+	}
+	base := splitMergeLines(normalizeText(baseContent))
+	current := splitMergeLines(normalizeText(currentContent))
+	generated := splitMergeLines(normalizeText(generatedContent))
+
+	currentHunks := diffLines(base, current)
+	generatedHunks := diffLines(base, generated)
+
+	var sb strings.Builder
+	conflicts := 0
+	basePos := 0
+	i, j := 0, 0
+	for i < len(currentHunks) || j < len(generatedHunks) {
+		// the group starts with the first hunk and grows as long as hunks of either side overlap it.
+		var group mergeHunkGroup
+		switch {
+		case j >= len(generatedHunks) || (i < len(currentHunks) && currentHunks[i].aStart <= generatedHunks[j].aStart):
+			group = newMergeHunkGroup(currentHunks[i], true)
+			i++
+		default:
+			group = newMergeHunkGroup(generatedHunks[j], false)
+			j++
+		}
+
+		for {
+			if i < len(currentHunks) && group.overlaps(currentHunks[i]) {
+				group.add(currentHunks[i], true)
+				i++
+			} else if j < len(generatedHunks) && group.overlaps(generatedHunks[j]) {
+				group.add(generatedHunks[j], false)
+				j++
+			} else {
+				break
+			}
+		}
+
+		writeMergeLines(&sb, base[basePos:group.aStart])
+		basePos = group.aEnd
+
+		currentSide := group.side(base, current, group.current)
+		generatedSide := group.side(base, generated, group.generated)
+		switch {
+		case len(group.current) == 0:
+			writeMergeLines(&sb, generatedSide)
+		case len(group.generated) == 0 || equalMergeLines(currentSide, generatedSide):
+			writeMergeLines(&sb, currentSide)
+		default:
+			conflicts++
+			sb.WriteString(ConflictMarkerCurrent + "\n")
+			writeMergeLines(&sb, currentSide)
+			sb.WriteString(ConflictMarkerSeparator + "\n")
+			writeMergeLines(&sb, generatedSide)
+			sb.WriteString(ConflictMarkerGenerated + "\n")
+		}
+	}
+
+	writeMergeLines(&sb, base[basePos:])
+	return tf.Format([]byte(sb.String())), conflicts
+}
+
+// lineHunk is a change: the lines [aStart, aEnd) of the base are replaced by the lines [bStart, bEnd) of the other side.
+type lineHunk struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+type mergeHunkGroup struct {
+	aStart, aEnd int
+	current      []lineHunk
+	generated    []lineHunk
+}
+
+func newMergeHunkGroup(h lineHunk, isCurrent bool) mergeHunkGroup {
+	g := mergeHunkGroup{aStart: h.aStart, aEnd: h.aEnd}
+	g.add(h, isCurrent)
+	return g
+}
+
+// overlaps reports if h touches the base range of the group: adjacent changes are considered conflicting like diff3 does.
+func (g *mergeHunkGroup) overlaps(h lineHunk) bool {
+	return h.aStart <= g.aEnd && g.aStart <= h.aEnd
+}
+
+func (g *mergeHunkGroup) add(h lineHunk, isCurrent bool) {
+	if isCurrent {
+		g.current = append(g.current, h)
+	} else {
+		g.generated = append(g.generated, h)
+	}
+
+	g.aStart = min(g.aStart, h.aStart)
+	g.aEnd = max(g.aEnd, h.aEnd)
+}
+
+// side returns the content of the group range in the other version given the hunks of that version.
+func (g *mergeHunkGroup) side(base []string, other []string, hunks []lineHunk) []string {
+	var out []string
+	pos := g.aStart
+	for _, h := range hunks {
+		out = append(out, base[pos:h.aStart]...)
+		out = append(out, other[h.bStart:h.bEnd]...)
+		pos = h.aEnd
+	}
+
+	return append(out, base[pos:g.aEnd]...)
+}
+
+func splitMergeLines(p []byte) []string {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")
+}
+
+func equalMergeLines(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeMergeLines(sb *strings.Builder, lines []string) {
+	for _, l := range lines {
+		sb.WriteString(l)
+		sb.WriteString("\n")
+	}
+}
+
+// diffLines returns the changes from a to b computed with the linear space variant of the Myers algorithm: the middle snake of the
+// shortest edit script splits the problem in two halves solved recursively, so the memory is O(N+M) and the time O((N+M)D).
+func diffLines(a []string, b []string) []lineHunk {
+	// the lines are compared as ids.
+	ids := make(map[string]int)
+	lineIds := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+
+	// the lines missing from the other side cannot match: they are left out of the search, which makes a full rewrite linear.
+	aIds, bIds := lineIds(a), lineIds(b)
+	aLines, bLines := keepCommonLines(aIds, bIds), keepCommonLines(bIds, aIds)
+	d := lineDiff{vf: make([]int, 2*(len(aLines)+len(bLines))+3), vb: make([]int, 2*(len(aLines)+len(bLines))+3)}
+	for _, i := range aLines {
+		d.a = append(d.a, aIds[i])
+	}
+	for _, i := range bLines {
+		d.b = append(d.b, bIds[i])
+	}
+	d.compare(0, len(d.a), 0, len(d.b))
+
+	n, m := len(a), len(b)
+	var hunks []lineHunk
+	prevA, prevB := 0, 0
+	for _, mt := range d.matches {
+		mt = lineMatch{aLines[mt.a], bLines[mt.b]}
+		if mt.a > prevA || mt.b > prevB {
+			hunks = append(hunks, lineHunk{aStart: prevA, aEnd: mt.a, bStart: prevB, bEnd: mt.b})
+		}
+		prevA, prevB = mt.a+1, mt.b+1
+	}
+
+	if prevA < n || prevB < m {
+		hunks = append(hunks, lineHunk{aStart: prevA, aEnd: n, bStart: prevB, bEnd: m})
+	}
+
+	return hunks
+}
+
+// keepCommonLines returns the indexes of the lines of a that are in b as well.
+func keepCommonLines(a []int, b []int) []int {
+	inB := make(map[int]struct{}, len(b))
+	for _, id := range b {
+		inB[id] = struct{}{}
+	}
+
+	var out []int
+	for i, id := range a {
+		if _, ok := inB[id]; ok {
+			out = append(out, i)
+		}
+	}
+
+	return out
+}
+
+type lineMatch struct{ a, b int }
+
+// lineDiff holds the state of diffLines: vf and vb are the furthest reaching paths of the forward and backward searches, reused
+// by every step of the recursion, and matches the matching lines in increasing order.
+type lineDiff struct {
+	a, b    []int
+	vf, vb  []int
+	matches []lineMatch
+}
+
+// compare adds the matching lines of a[aLo:aHi] and b[bLo:bHi].
+func (d *lineDiff) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches = append(d.matches, lineMatch{aLo, bLo})
+		aLo++
+		bLo++
+	}
+
+	suffixLen := 0
+	for aLo < aHi-suffixLen && bLo < bHi-suffixLen && d.a[aHi-suffixLen-1] == d.b[bHi-suffixLen-1] {
+		suffixLen++
+	}
+	aHi, bHi = aHi-suffixLen, bHi-suffixLen
+
+	// having removed the common prefix and suffix, two non empty ranges differ by two edits at least: the halves are smaller.
+	if aLo < aHi && bLo < bHi {
+		x0, y0, x1, y1 := d.middleSnake(aLo, aHi, bLo, bHi)
+		d.compare(aLo, x0, bLo, y0)
+		for ; x0 < x1; x0, y0 = x0+1, y0+1 {
+			d.matches = append(d.matches, lineMatch{x0, y0})
+		}
+		d.compare(x1, aHi, y1, bHi)
+	}
+
+	for i := 0; i < suffixLen; i++ {
+		d.matches = append(d.matches, lineMatch{aHi + i, bHi + i})
+	}
+}
+
+// middleSnake returns the start and the end of the snake in the middle of a shortest edit script of a[aLo:aHi] to b[bLo:bHi].
+// The forward search runs on the diagonals k = x - y, the backward one on the diagonals of the reversed ranges.
+func (d *lineDiff) middleSnake(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	off := n + m + 1
+	vf, vb := d.vf, d.vb
+	vf[off+1], vb[off+1] = 0, 0
+
+	for step := 0; step <= (n+m+1)/2; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+
+			vf[off+k] = x
+			if kr := delta - k; odd && kr >= -(step-1) && kr <= step-1 && x+vb[off+kr] >= n {
+				return aLo + x0, bLo + y0, aLo + x, bLo + y
+			}
+		}
+
+		for kr := -step; kr <= step; kr += 2 {
+			var x int
+			if kr == -step || (kr != step && vb[off+kr-1] < vb[off+kr+1]) {
+				x = vb[off+kr+1]
+			} else {
+				x = vb[off+kr-1] + 1
+			}
+
+			y := x - kr
+			x0, y0 := x, y
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+
+			vb[off+kr] = x
+			if k := delta - kr; !odd && k >= -step && k <= step && x+vf[off+k] >= n {
+				return aHi - x, bHi - y, aHi - x0, bHi - y0
+			}
+		}
+	}
+
+	// not reachable: the searches meet within (n+m+1)/2 steps.
+	return aLo, bLo, aHi, bHi
+}
+
+func (cfg *ApplyOptions) shadowFolderPath() string {
+	folder := cfg.shadowFolder
+	if folder == "" {
+		folder = ShadowFolder
+	}
+
+	if !filepath.IsAbs(folder) {
+		folder = filepath.Join(cfg.writer.TargetFolder(), folder)
+	}
+
+	return folder
+}
+
+// shadowPath returns the path of the copy of the last generated content of the target, used as merge base by ConflictModeMerge.
+func (cfg *ApplyOptions) shadowPath(targetPath string) string {
+	return filepath.Join(cfg.shadowFolderPath(), relativeTargetPath(cfg.writer.TargetFolder(), targetPath))
+}
+
+// isShadowEnabled reports if the generated content has to be saved as merge base: either asked or needed by the ConflictModeMerge
+// of the options. A file merged because a conflict resolver has chosen so gets its copy anyway.
+func (cfg *ApplyOptions) isShadowEnabled() bool {
+	if cfg.shadowFolder != "" || cfg.defaultConflictMode == ConflictModeMerge {
+		return true
+	}
+
+	for _, p := range cfg.onConflictPolicies {
+		if p.mode == ConflictModeMerge {
+			return true
+		}
+	}
+
+	return false
+}
+
+// planShadowCopy returns the shadow copy to be written for the target. The copy is not written again if up to date.
+func planShadowCopy(cfg *ApplyOptions, targetPath string, content []byte) (OpNode, error) {
+	const semLogContext = "schematics::plan-shadow-copy"
+
+	shadowPath := cfg.shadowPath(targetPath)
+	if cfg.writer.FileExists(shadowPath) {
+		current, err := cfg.writer.ReadFile(shadowPath)
+		if err != nil {
+			log.Error().Err(err).Msg(semLogContext)
+			return OpNode{}, err
+		}
+
+		if bytes.Equal(current, content) {
+			return OpNode{}, nil
+		}
+	}
+
+	return OpNode{Path: shadowPath, Content: content}, nil
+}
+
+// threeWayMergeOfFile merges the existing target with the generated content using the shadow copy as base. The bool is false if
+// the base is not available.
+func threeWayMergeOfFile(cfg *ApplyOptions, targetPath string, content []byte) ([]byte, int, bool, error) {
+	const semLogContext = "schematics::three-way-merge-of-file"
+
+	shadowPath := cfg.shadowPath(targetPath)
+	if !cfg.writer.FileExists(shadowPath) {
+		log.Warn().Str("path", targetPath).Msg(semLogContext + " - merge base not found")
+		return nil, 0, false, nil
+	}
+
+	base, err := cfg.writer.ReadFile(shadowPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, 0, false, err
+	}
+
+	current, err := cfg.writer.ReadFile(targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg(semLogContext)
+		return nil, 0, false, err
+	}
+
+	merged, conflicts := ThreeWayMerge(base, current, content)
+	if conflicts > 0 {
+		log.Warn().Str("path", targetPath).Int("conflicts", conflicts).Msg(semLogContext)
+	}
+
+	return merged, conflicts, true, nil
+}
@@ -0,0 +1,79 @@
+package schematics_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-schematics/schematics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThreeWayMerge(t *testing.T) {
+
+	base := []byte("a\nb\nc\nd\ne\n")
+
+	// changes on different lines are both applied.
+	merged, conflicts := schematics.ThreeWayMerge(base, []byte("a\nB\nc\nd\ne\n"), []byte("a\nb\nc\nd\nE\nf\n"))
+	require.Equal(t, 0, conflicts)
+	require.Equal(t, "a\nB\nc\nd\nE\nf\n", string(merged))
+
+	// the same change on both sides is not a conflict.
+	merged, conflicts = schematics.ThreeWayMerge(base, []byte("a\nb\nC\nd\ne\n"), []byte("a\nb\nC\nd\ne\n"))
+	require.Equal(t, 0, conflicts)
+	require.Equal(t, "a\nb\nC\nd\ne\n", string(merged))
+
+	// different changes of the same lines.
+	merged, conflicts = schematics.ThreeWayMerge(base, []byte("a\nb\nmine\nd\ne\n"), []byte("a\nb\ntheirs\nd\ne\n"))
+	require.Equal(t, 1, conflicts)
+	require.Equal(t, "a\nb\n<<<<<<< current\nmine\n=======\ntheirs\n>>>>>>> generated\nd\ne\n", string(merged))
+
+	// deletions and insertions.
+	merged, conflicts = schematics.ThreeWayMerge(base, []byte("a\nc\nd\ne\n"), []byte("x\na\nb\nc\nd\ne\n"))
+	require.Equal(t, 0, conflicts)
+	require.Equal(t, "x\na\nc\nd\ne\n", string(merged))
+
+	// large files rewritten by the generation are merged in linear space.
+	var bigBase, bigCurrent, bigGenerated strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&bigBase, "line %d\n", i)
+		fmt.Fprintf(&bigGenerated, "generated %d\n", i)
+		if i == 0 {
+			bigCurrent.WriteString("user\n")
+		}
+		fmt.Fprintf(&bigCurrent, "line %d\n", i)
+	}
+
+	merged, conflicts = schematics.ThreeWayMerge([]byte(bigBase.String()), []byte(bigCurrent.String()), []byte(bigGenerated.String()))
+	require.Equal(t, 1, conflicts)
+	require.True(t, strings.HasPrefix(string(merged), "<<<<<<< current\nuser\nline 0\n"))
+}
+
+func TestApplyConflictModeMerge(t *testing.T) {
+
+	v1 := []byte("package main\n\nfunc main() {\n\tstart()\n}\n")
+	v2 := []byte("package main\n\nimport \"os\"\n\nfunc main() {\n\tstart()\n\tos.Exit(0)\n}\n")
+
+	store := schematics.NewApplyMemoryStore("/tmp")
+	opts := []schematics.ApplyOption{schematics.WithStore(store), schematics.WithApplyDefaultConflictMode(schematics.ConflictModeMerge)}
+
+	_, err := schematics.Apply([]schematics.OpNode{schematics.NewOpNode("main.go", v1)}, opts...)
+	require.NoError(t, err)
+	require.Equal(t, string(v1), string(store.Files()["/tmp/"+schematics.ShadowFolder+"/main.go"]))
+
+	// the user adds a line outside any region.
+	_ = store.WriteFile("/tmp/main.go", []byte("// Package main is mine.\npackage main\n\nfunc main() {\n\tstart()\n}\n"))
+
+	res, err := schematics.Apply([]schematics.OpNode{schematics.NewOpNode("main.go", v2)}, opts...)
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionMerge, res.Files[0].Action)
+	require.Equal(t, 0, res.Files[0].Conflicts)
+	require.Equal(t, "// Package main is mine.\npackage main\n\nimport \"os\"\n\nfunc main() {\n\tstart()\n\tos.Exit(0)\n}\n", string(store.Files()["/tmp/main.go"]))
+	require.Equal(t, string(v2), string(store.Files()["/tmp/"+schematics.ShadowFolder+"/main.go"]))
+
+	// without a base the generated content is written as .new.
+	_ = store.WriteFile("/tmp/other.go", []byte("package other\n"))
+	res, err = schematics.Apply([]schematics.OpNode{schematics.NewOpNode("other.go", []byte("package other\n\nvar x int\n"))}, opts...)
+	require.NoError(t, err)
+	require.Equal(t, schematics.PlanActionWriteNew, res.Files[0].Action)
+}